@@ -0,0 +1,19 @@
+package echootelmetrics
+
+import (
+	realprometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+// ExponentialBuckets returns count buckets, where the lowest bucket has an upper bound of start
+// and each following bucket's upper bound is factor times the previous one, e.g. for DurationBuckets.
+// Like prometheus.ExponentialBuckets, it panics if count is less than 1, start is not positive
+// or factor is not greater than 1.
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	return realprometheus.ExponentialBuckets(start, factor, count)
+}
+
+// LinearBuckets returns count buckets, each width wide, where the lowest bucket has an upper bound of start.
+// Like prometheus.LinearBuckets, it panics if count is less than 1.
+func LinearBuckets(start, width float64, count int) []float64 {
+	return realprometheus.LinearBuckets(start, width, count)
+}
@@ -0,0 +1,41 @@
+package echootelmetrics
+
+import (
+	"context"
+	"runtime"
+	"runtime/debug"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// registerBuildInfo installs the build info gauge, a constant 1 carrying the service version,
+// the Go version and the VCS commit, like the Prometheus `build_info` convention.
+func (p *Metrics) registerBuildInfo(meter metric.Meter) error {
+	attrs := attribute.NewSet(
+		ServiceVersion.String(p.ServiceVersion),
+		GoVersion.String(runtime.Version()),
+		Commit.String(vcsRevision()),
+	)
+	_, err := meter.Int64ObservableGauge(
+		MetricHTTPServerBuildInfo,
+		metric.WithDescription("Constant 1 labeled with the service version, Go version and commit."),
+		metric.WithInt64Callback(func(ctx context.Context, o metric.Int64Observer) error {
+			o.Observe(1, metric.WithAttributeSet(attrs))
+			return nil
+		}),
+	)
+	return err
+}
+
+// vcsRevision returns the commit stamped into the binary by the go tool, or "unknown"
+func vcsRevision() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" && setting.Value != "" {
+				return setting.Value
+			}
+		}
+	}
+	return "unknown"
+}
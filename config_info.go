@@ -0,0 +1,58 @@
+package echootelmetrics
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// registerConfigInfo installs the config info gauge, a constant 1 carrying every boolean
+// MiddlewareConfig option as a label, so a fleet can be audited for enabled features.
+func (p *Metrics) registerConfigInfo(meter metric.Meter) error {
+	attrs := configInfoAttributes(p.MiddlewareConfig)
+	_, err := meter.Int64ObservableGauge(
+		MetricConfigInfo,
+		metric.WithDescription("Constant 1 labeled with the boolean options of the echo-otel-metrics middleware."),
+		metric.WithInt64Callback(func(ctx context.Context, o metric.Int64Observer) error {
+			o.Observe(1, metric.WithAttributeSet(attrs))
+			return nil
+		}),
+	)
+	return err
+}
+
+// configInfoAttributes turns each boolean field of the config into a snake_case attribute
+func configInfoAttributes(config *MiddlewareConfig) attribute.Set {
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+
+	var attrs []attribute.KeyValue
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Type.Kind() != reflect.Bool {
+			continue
+		}
+		attrs = append(attrs, attribute.Bool(toSnakeCase(t.Field(i).Name), v.Field(i).Bool()))
+	}
+	return attribute.NewSet(attrs...)
+}
+
+// toSnakeCase converts a Go identifier like WithRequestURLAndHeaderSize to with_request_url_and_header_size
+func toSnakeCase(s string) string {
+	runes := []rune(s)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextIsLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextIsLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
@@ -43,8 +43,8 @@ func main() {
 	e.Use(middleware.Recover())
 
 	prom := echootelmetrics.New(echootelmetrics.MiddlewareConfig{ServiceName: serviceName, ServiceVersion: "v0.1.0", Skipper: URLSkipper})
-	e.Use(prom.Middleware())
-	e.GET("/metrics", prom.ExporterHandler())
+	// register the middleware and the /metrics route
+	prom.Setup(e)
 
 	// Route => handler
 	e.GET("/", func(c echo.Context) error {
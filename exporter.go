@@ -0,0 +1,122 @@
+package echootelmetrics
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/prometheus"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// ExporterKind selects where the middleware metrics go.
+type ExporterKind int
+
+const (
+	// ExporterPrometheus exposes the metrics for a Prometheus scrape via ExporterHandler. This is the default.
+	ExporterPrometheus ExporterKind = iota
+	// ExporterOTLPGRPC periodically pushes the metrics over OTLP/gRPC.
+	// The exporter is configured by the standard OTEL_EXPORTER_OTLP_* environment variables.
+	ExporterOTLPGRPC
+	// ExporterOTLPHTTP periodically pushes the metrics over OTLP/HTTP.
+	// The exporter is configured by the standard OTEL_EXPORTER_OTLP_* environment variables.
+	ExporterOTLPHTTP
+)
+
+// String returns the name of the exporter kind
+func (k ExporterKind) String() string {
+	switch k {
+	case ExporterPrometheus:
+		return "prometheus"
+	case ExporterOTLPGRPC:
+		return "otlpgrpc"
+	case ExporterOTLPHTTP:
+		return "otlphttp"
+	default:
+		return fmt.Sprintf("ExporterKind(%d)", int(k))
+	}
+}
+
+// Temporality selects whether the pushed sums and histograms are cumulative or delta.
+type Temporality int
+
+const (
+	// TemporalityCumulative reports the values accumulated since the start. This is the default,
+	// and the only one the Prometheus exporter supports.
+	TemporalityCumulative Temporality = iota
+	// TemporalityDelta reports the counters and histograms accumulated since the previous export,
+	// as preferred by some OTLP backends. Up/down counters and gauges stay cumulative.
+	TemporalityDelta
+)
+
+// String returns the name of the temporality
+func (t Temporality) String() string {
+	switch t {
+	case TemporalityCumulative:
+		return "cumulative"
+	case TemporalityDelta:
+		return "delta"
+	default:
+		return fmt.Sprintf("Temporality(%d)", int(t))
+	}
+}
+
+// TemporalitySelector returns the selector of the temporality, e.g. for a custom MiddlewareConfig.Reader
+// built with sdkmetric.WithTemporalitySelector
+func (t Temporality) TemporalitySelector() sdkmetric.TemporalitySelector {
+	if t != TemporalityDelta {
+		return sdkmetric.DefaultTemporalitySelector
+	}
+	return func(kind sdkmetric.InstrumentKind) metricdata.Temporality {
+		switch kind {
+		case sdkmetric.InstrumentKindCounter, sdkmetric.InstrumentKindHistogram, sdkmetric.InstrumentKindObservableCounter:
+			return metricdata.DeltaTemporality
+		default:
+			return metricdata.CumulativeTemporality
+		}
+	}
+}
+
+// newReader builds the sdkmetric.Reader wired into the MeterProvider,
+// a pre-built MiddlewareConfig.Reader always wins over ExporterKind.
+func (p *Metrics) newReader(opts []prometheus.Option) (sdkmetric.Reader, error) {
+	if p.Reader != nil {
+		return p.Reader, nil
+	}
+
+	switch p.ExporterKind {
+	case ExporterPrometheus:
+		return prometheus.New(opts...)
+	case ExporterOTLPGRPC:
+		exporter, err := otlpmetricgrpc.New(context.Background(),
+			otlpmetricgrpc.WithTemporalitySelector(p.Temporality.TemporalitySelector()))
+		if err != nil {
+			return nil, err
+		}
+		return sdkmetric.NewPeriodicReader(exporter, p.periodicReaderOptions()...), nil
+	case ExporterOTLPHTTP:
+		exporter, err := otlpmetrichttp.New(context.Background(),
+			otlpmetrichttp.WithTemporalitySelector(p.Temporality.TemporalitySelector()))
+		if err != nil {
+			return nil, err
+		}
+		return sdkmetric.NewPeriodicReader(exporter, p.periodicReaderOptions()...), nil
+	default:
+		return nil, fmt.Errorf("unsupported exporter kind: %s", p.ExporterKind)
+	}
+}
+
+func (p *Metrics) periodicReaderOptions() []sdkmetric.PeriodicReaderOption {
+	var opts []sdkmetric.PeriodicReaderOption
+	if p.PushInterval > 0 {
+		opts = append(opts, sdkmetric.WithInterval(p.PushInterval))
+	}
+	return opts
+}
+
+// isPrometheusPull reports whether the metrics are exposed via the Prometheus exporter
+func (p *Metrics) isPrometheusPull() bool {
+	return p.Reader == nil && p.ExporterKind == ExporterPrometheus
+}
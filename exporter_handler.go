@@ -0,0 +1,111 @@
+package echootelmetrics
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// errScrapeTooLarge is returned by limitedResponseWriter once MiddlewareConfig.MaxScrapeBytes is exceeded
+var errScrapeTooLarge = errors.New("scrape response exceeds MaxScrapeBytes")
+
+// BasicAuth is the username and password required by MiddlewareConfig.MetricsAuth
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+// authorize rejects the requests to the metrics routes which pass neither the MetricsAuth
+// nor the MetricsAuthorizer check, it returns nil if none of them is configured.
+func (p *Metrics) authorize(c echo.Context) error {
+	if p.MetricsAuth == nil && p.MetricsAuthorizer == nil {
+		return nil
+	}
+	if p.MetricsAuth != nil {
+		if username, password, ok := c.Request().BasicAuth(); ok &&
+			subtle.ConstantTimeCompare([]byte(username), []byte(p.MetricsAuth.Username)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(p.MetricsAuth.Password)) == 1 {
+			return nil
+		}
+	}
+	if p.MetricsAuthorizer != nil && p.MetricsAuthorizer(c) {
+		return nil
+	}
+	if p.MetricsAuth != nil {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="metrics"`)
+	}
+	return echo.ErrUnauthorized
+}
+
+// limitedResponseWriter holds back the response up to remaining bytes, so a scrape exceeding
+// the limit can be answered with an error instead of a truncated body.
+type limitedResponseWriter struct {
+	http.ResponseWriter
+	remaining int
+	exceeded  bool
+	status    int
+	body      bytes.Buffer
+}
+
+func (w *limitedResponseWriter) WriteHeader(code int) {
+	w.status = code
+}
+
+func (w *limitedResponseWriter) Write(b []byte) (int, error) {
+	if w.exceeded || len(b) > w.remaining {
+		w.exceeded = true
+		return 0, errScrapeTooLarge
+	}
+	n, _ := w.body.Write(b)
+	w.remaining -= n
+	return n, nil
+}
+
+// flush writes the held back response, it must not be called once the limit is exceeded
+func (w *limitedResponseWriter) flush() error {
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	_, err := w.ResponseWriter.Write(w.body.Bytes())
+	return err
+}
+
+// jsonErrorResponseWriter holds back error responses written by the promhttp handler,
+// so they can be rewritten as a JSON body once the handler is done.
+type jsonErrorResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *jsonErrorResponseWriter) WriteHeader(code int) {
+	if code >= http.StatusInternalServerError {
+		w.status = code
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *jsonErrorResponseWriter) Write(b []byte) (int, error) {
+	if w.status != 0 {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// serveJSONErrors serves h on rw, rewriting its error responses as `{"error": "..."}`
+func serveJSONErrors(c echo.Context, rw http.ResponseWriter, h http.Handler) error {
+	w := &jsonErrorResponseWriter{ResponseWriter: rw}
+	h.ServeHTTP(w, c.Request())
+
+	if w.status == 0 {
+		return nil
+	}
+	c.Response().Header().Del(echo.HeaderContentType)
+	c.Response().Header().Del(echo.HeaderXContentTypeOptions)
+	return c.JSON(w.status, map[string]string{"error": strings.TrimSpace(w.body.String())})
+}
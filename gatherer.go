@@ -0,0 +1,189 @@
+package echootelmetrics
+
+import (
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	realprometheus "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+)
+
+// exportedName returns the metric family name as it is served in the text exposition format,
+// the otel exporter gathers UTF-8 names like `http.server.request.duration_seconds`.
+func exportedName(mf *dto.MetricFamily) string {
+	return model.EscapeName(mf.GetName(), model.UnderscoreEscaping)
+}
+
+// filteredGatherer omits the metric families rejected by filter from the wrapped Gatherer
+type filteredGatherer struct {
+	gatherer realprometheus.Gatherer
+	filter   func(metricName string) bool
+}
+
+// Gather implements prometheus.Gatherer
+func (g filteredGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.gatherer.Gather()
+	kept := mfs[:0]
+	for _, mf := range mfs {
+		if g.filter(exportedName(mf)) {
+			kept = append(kept, mf)
+		}
+	}
+	return kept, err
+}
+
+// sanitizingGatherer renames the metric families and their labels of the wrapped Gatherer
+type sanitizingGatherer struct {
+	gatherer realprometheus.Gatherer
+	sanitize func(name string) string
+}
+
+// Gather implements prometheus.Gatherer
+func (g sanitizingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.gatherer.Gather()
+	for _, mf := range mfs {
+		mf.Name = proto.String(g.sanitize(exportedName(mf)))
+		for _, m := range mf.GetMetric() {
+			for _, label := range m.GetLabel() {
+				label.Name = proto.String(g.sanitize(model.EscapeName(label.GetName(), model.UnderscoreEscaping)))
+			}
+		}
+	}
+	return mfs, err
+}
+
+// Gatherer returns the Gatherer the middleware metrics are collected from, MiddlewareConfig.Gatherer or
+// Registry, e.g. to embed the scrape output into an existing admin page or to combine it with other registries
+// in a prometheus.Gatherers. The ExportFilter and the NameSanitizer are only applied by ExporterHandler.
+func (p *Metrics) Gatherer() realprometheus.Gatherer {
+	return p.active().MiddlewareConfig.Gatherer
+}
+
+// gatherer returns the Gatherer served by ExporterHandler, with the ExportFilter and the NameSanitizer applied
+func (p *Metrics) gatherer() realprometheus.Gatherer {
+	var gatherer realprometheus.Gatherer = p.MiddlewareConfig.Gatherer
+	if p.ExportFilter != nil {
+		gatherer = filteredGatherer{gatherer: gatherer, filter: p.ExportFilter}
+	}
+	if p.NameSanitizer != nil {
+		gatherer = sanitizingGatherer{gatherer: gatherer, sanitize: p.NameSanitizer}
+	}
+	return gatherer
+}
+
+// WriteGatheredMetrics gathers collected metrics and writes them to given writer
+func WriteGatheredMetrics(writer io.Writer, gatherer realprometheus.Gatherer) error {
+	metricFamilies, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	for _, mf := range metricFamilies {
+		if _, err := expfmt.MetricFamilyToText(writer, mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteGatheredMetricsOpenMetrics gathers collected metrics and writes them to given writer in the
+// OpenMetrics format, which unlike WriteGatheredMetrics keeps the exemplars (see MiddlewareConfig.WithExemplars)
+// and the `_created` lines of the collectors reporting a created timestamp.
+func WriteGatheredMetricsOpenMetrics(writer io.Writer, gatherer realprometheus.Gatherer) error {
+	metricFamilies, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	enc := expfmt.NewEncoder(writer, expfmt.NewFormat(expfmt.TypeOpenMetrics), expfmt.WithCreatedLines())
+	for _, mf := range metricFamilies {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+	// the encoder writes the final `# EOF` line on Close
+	return enc.(expfmt.Closer).Close()
+}
+
+// Snapshot gathers the metrics served by ExporterHandler (ExportFilter and NameSanitizer applied) into a map
+// keyed by their series in the text exposition format, e.g. `requests_total{http_route="/ping",...}`, so tests
+// can assert a value without scraping and parsing the text. The labels are sorted by name.
+// A histogram expands to `_sum`, `_count` and one `_bucket` entry per bucket including `le="+Inf"`,
+// a summary to `_sum`, `_count` and one entry per quantile.
+func (p *Metrics) Snapshot() (map[string]float64, error) {
+	metricFamilies, err := p.active().gatherer().Gather()
+	if err != nil {
+		return nil, err
+	}
+	snapshot := make(map[string]float64)
+	for _, mf := range metricFamilies {
+		name := exportedName(mf)
+		for _, m := range mf.GetMetric() {
+			switch {
+			case m.GetCounter() != nil:
+				snapshot[seriesKey(name, m, "", 0)] = m.GetCounter().GetValue()
+			case m.GetGauge() != nil:
+				snapshot[seriesKey(name, m, "", 0)] = m.GetGauge().GetValue()
+			case m.GetUntyped() != nil:
+				snapshot[seriesKey(name, m, "", 0)] = m.GetUntyped().GetValue()
+			case m.GetHistogram() != nil:
+				h := m.GetHistogram()
+				snapshot[seriesKey(name+"_sum", m, "", 0)] = h.GetSampleSum()
+				snapshot[seriesKey(name+"_count", m, "", 0)] = float64(h.GetSampleCount())
+				for _, b := range h.GetBucket() {
+					snapshot[seriesKey(name+"_bucket", m, model.BucketLabel, b.GetUpperBound())] = float64(b.GetCumulativeCount())
+				}
+				snapshot[seriesKey(name+"_bucket", m, model.BucketLabel, math.Inf(1))] = float64(h.GetSampleCount())
+			case m.GetSummary() != nil:
+				s := m.GetSummary()
+				snapshot[seriesKey(name+"_sum", m, "", 0)] = s.GetSampleSum()
+				snapshot[seriesKey(name+"_count", m, "", 0)] = float64(s.GetSampleCount())
+				for _, q := range s.GetQuantile() {
+					snapshot[seriesKey(name, m, model.QuantileLabel, q.GetQuantile())] = q.GetValue()
+				}
+			}
+		}
+	}
+	return snapshot, nil
+}
+
+// labelValueEscaper escapes label values like the text exposition format
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// seriesKey returns the series of m in the text exposition format, with the extra label (le or quantile)
+// appended if set
+func seriesKey(name string, m *dto.Metric, extraLabel string, extraValue float64) string {
+	if len(m.GetLabel()) == 0 && extraLabel == "" {
+		return name
+	}
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, label := range m.GetLabel() {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(model.EscapeName(label.GetName(), model.UnderscoreEscaping))
+		b.WriteString(`="`)
+		b.WriteString(labelValueEscaper.Replace(label.GetValue()))
+		b.WriteByte('"')
+	}
+	if extraLabel != "" {
+		if len(m.GetLabel()) > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extraLabel)
+		b.WriteString(`="`)
+		if math.IsInf(extraValue, 1) {
+			b.WriteString("+Inf")
+		} else {
+			b.WriteString(strconv.FormatFloat(extraValue, 'g', -1, 64))
+		}
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
@@ -0,0 +1,139 @@
+package echootelmetrics
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"go.opentelemetry.io/otel"
+)
+
+// graphiteTagReplacer replaces the characters which are not allowed in Graphite tag values
+var graphiteTagReplacer = strings.NewReplacer(";", "_", "~", "_", " ", "_", "\n", "_")
+
+// GraphitePush gathers the metrics every interval, the same way ExporterHandler does, and pushes them
+// to the Graphite (Carbon) plaintext listener at address as tagged series:
+//
+//	prefix.metric;tag=value value timestamp
+//
+// Histograms are pushed as their `_bucket` (tagged with `le`), `_sum` and `_count` series.
+// Each push opens a new TCP connection, failed pushes are reported to the otel error handler
+// and retried on the next tick. Call stop to end the pushes, it waits for the running one.
+// The interval must be positive.
+func (p *Metrics) GraphitePush(ctx context.Context, address, prefix string, interval time.Duration) (stop func(), err error) {
+	// checked here, time.NewTicker would panic in the background goroutine
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid graphite push interval %s, must be positive", interval)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := p.pushGraphite(ctx, address, prefix); err != nil && ctx.Err() == nil {
+					otel.Handle(fmt.Errorf("graphite push to %s: %w", address, err))
+				}
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}, nil
+}
+
+// pushGraphite gathers the metrics and writes them to a new connection to address
+func (p *Metrics) pushGraphite(ctx context.Context, address, prefix string) error {
+	mfs, err := p.gatherer().Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics: %w", err)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+	writeGraphite(w, mfs, prefix, time.Now())
+	return w.Flush()
+}
+
+// writeGraphite writes the metric families in the Graphite plaintext protocol, with the labels as tags
+func writeGraphite(w *bufio.Writer, mfs []*dto.MetricFamily, prefix string, now time.Time) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	line := func(name, tags string, value float64) {
+		w.WriteString(name)
+		w.WriteString(tags)
+		w.WriteByte(' ')
+		w.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+		w.WriteByte(' ')
+		w.WriteString(timestamp)
+		w.WriteByte('\n')
+	}
+
+	for _, mf := range mfs {
+		name := exportedName(mf)
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		for _, m := range mf.GetMetric() {
+			tags := graphiteTags(m.GetLabel())
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				line(name, tags, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				line(name, tags, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				line(name, tags, m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					line(name+"_bucket", tags+";le="+strconv.FormatFloat(b.GetUpperBound(), 'g', -1, 64), float64(b.GetCumulativeCount()))
+				}
+				line(name+"_bucket", tags+";le=+Inf", float64(h.GetSampleCount()))
+				line(name+"_sum", tags, h.GetSampleSum())
+				line(name+"_count", tags, float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					line(name, tags+";quantile="+strconv.FormatFloat(q.GetQuantile(), 'g', -1, 64), q.GetValue())
+				}
+				line(name+"_sum", tags, s.GetSampleSum())
+				line(name+"_count", tags, float64(s.GetSampleCount()))
+			}
+		}
+	}
+}
+
+// graphiteTags formats the labels as `;name=value` tags, named like in the text exposition format. Graphite does not allow empty tag values
+func graphiteTags(labels []*dto.LabelPair) string {
+	var b strings.Builder
+	for _, label := range labels {
+		if label.GetValue() == "" {
+			continue
+		}
+		b.WriteByte(';')
+		b.WriteString(model.EscapeName(label.GetName(), model.UnderscoreEscaping))
+		b.WriteByte('=')
+		b.WriteString(graphiteTagReplacer.Replace(label.GetValue()))
+	}
+	return b.String()
+}
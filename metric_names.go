@@ -0,0 +1,55 @@
+package echootelmetrics
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// MetricNames overrides the names of the main instruments, for organizations whose naming standards
+// differ from the semconv. Empty fields keep the default names. The Prometheus exporter still appends
+// the unit and `_total` suffixes, e.g. RequestDuration "api.latency" is exported as `api_latency_seconds`.
+type MetricNames struct {
+	// RequestDuration defaults to MetricHTTPServerRequestDuration
+	RequestDuration string
+	// Requests is the request counter, defaults to MetricRequests
+	Requests string
+	// ActiveRequests defaults to MetricHTTPServerActiveRequests
+	ActiveRequests string
+	// RequestBodySize defaults to MetricHTTPServerRequestBodySize
+	RequestBodySize string
+	// ResponseBodySize defaults to MetricHTTPServerResponseBodySize
+	ResponseBodySize string
+}
+
+// instrumentNameRegexp is the instrument name syntax of the OTel API
+var instrumentNameRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_./-]{0,254}$`)
+
+// withDefaults returns the names with the empty fields set to the default names
+func (n MetricNames) withDefaults() MetricNames {
+	defaults := []struct {
+		name     *string
+		fallback string
+	}{
+		{&n.RequestDuration, MetricHTTPServerRequestDuration},
+		{&n.Requests, MetricRequests},
+		{&n.ActiveRequests, MetricHTTPServerActiveRequests},
+		{&n.RequestBodySize, MetricHTTPServerRequestBodySize},
+		{&n.ResponseBodySize, MetricHTTPServerResponseBodySize},
+	}
+	for _, d := range defaults {
+		if *d.name == "" {
+			*d.name = d.fallback
+		}
+	}
+	return n
+}
+
+// validate reports the first name which is not a valid instrument name
+func (n MetricNames) validate() error {
+	for _, name := range []string{n.RequestDuration, n.Requests, n.ActiveRequests, n.RequestBodySize, n.ResponseBodySize} {
+		if !instrumentNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid metric name %q in MetricNames", name)
+		}
+	}
+	return nil
+}
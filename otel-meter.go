@@ -2,13 +2,23 @@
 package echootelmetrics
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"math/rand/v2"
 	"net"
 	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	otelruntime "go.opentelemetry.io/contrib/instrumentation/runtime"
 	"go.opentelemetry.io/otel/attribute"
 
 	"go.opentelemetry.io/otel"
@@ -19,6 +29,7 @@ import (
 	"go.opentelemetry.io/otel/sdk/metric/exemplar"
 	"go.opentelemetry.io/otel/sdk/resource"
 	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -26,8 +37,22 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// Meter can be a global/package variable.
-var meter = otel.GetMeterProvider().Meter("echo")
+// noMetricsRouteNamePrefix marks a route name as opted out of the metrics, see SkipRouteMetrics
+const noMetricsRouteNamePrefix = "nometrics:"
+
+// DefaultBotUserAgentPatterns are the default MiddlewareConfig.BotUserAgentPatterns,
+// matching the common search engine, social media and monitoring crawlers.
+var DefaultBotUserAgentPatterns = []string{
+	"googlebot", "bingbot", "slurp", "duckduckbot", "baiduspider", "yandexbot", "applebot",
+	"facebookexternalhit", "twitterbot", "linkedinbot", "semrushbot", "ahrefsbot",
+	"bot/", "crawler", "spider",
+}
+
+// defaultMetricsPath is the default MiddlewareConfig.MetricsPath
+const defaultMetricsPath = "/metrics"
+
+// defaultScopeName is the default instrumentation scope name of the middleware meter
+const defaultScopeName = "echo"
 
 const (
 	_           = iota // ignore first value by assigning to blank identifier
@@ -37,17 +62,50 @@ const (
 	_TB
 )
 
+// defaultRecordAsyncBufferSize is the default buffer size for MiddlewareConfig.RecordAsync
+const defaultRecordAsyncBufferSize = 1024
+
 const (
 	unitDimensionless = "1"
 	unitBytes         = "By"
 	unitMilliseconds  = "ms"
+	unitSeconds       = "s"
 )
 
-// reqDurBucketsSeconds is the buckets for request duration. Here, we use the prometheus defaults
-var reqDurBucketsSeconds = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+// noAttributes is the measurement option used when an instrument is recorded without attributes
+var noAttributes = metric.WithAttributeSet(*attribute.EmptySet())
+
+// DefaultDurationBuckets is the buckets for request duration in seconds. Here, we use the prometheus defaults
+var DefaultDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// reqDurBucketsMilliseconds is DefaultDurationBuckets in milliseconds, for MiddlewareConfig.DurationUnit "ms"
+var reqDurBucketsMilliseconds = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// longDurationBucketsSeconds is the buckets for the long request duration histogram, from 0.5s up to 5 minutes
+var longDurationBucketsSeconds = []float64{0.5, 1.0, 1.5, 2.5, 5.0, 10.0, 15.0, 25.0, 40.0, 60, 90, 120, 150, 200, 250, 300}
 
-// byteBuckets is the buckets for request/response size. Here we define a spectrom from 1KB thru 1NB up to 10MB.
-var byteBuckets = []float64{1.0 * _KB, 2.0 * _KB, 5.0 * _KB, 10.0 * _KB, 100 * _KB, 500 * _KB, 1.0 * _MB, 2.5 * _MB, 5.0 * _MB, 10.0 * _MB}
+// defaultLongDurationThreshold is the default MiddlewareConfig.LongDurationThreshold
+const defaultLongDurationThreshold = 500 * time.Millisecond
+
+// concurrencyBuckets is the buckets for the concurrency histogram, from 1 up to 250 requests in flight.
+var concurrencyBuckets = []float64{1, 2, 5, 10, 25, 50, 100, 250}
+
+// headerBytesBuckets is the buckets for request URL length and header size, from 128B up to 64KB.
+var headerBytesBuckets = []float64{128, 256, 512, 1.0 * _KB, 2.0 * _KB, 4.0 * _KB, 8.0 * _KB, 16.0 * _KB, 32.0 * _KB, 64.0 * _KB}
+
+// setCookieCountBuckets is the buckets for the number of Set-Cookie headers per response
+var setCookieCountBuckets = []float64{0, 1, 2, 3, 5, 10, 20, 50}
+
+// DefaultSizeBuckets is the buckets for request/response size in bytes. Here we define a spectrom from 1KB thru 1NB up to 10MB.
+var DefaultSizeBuckets = []float64{1.0 * _KB, 2.0 * _KB, 5.0 * _KB, 10.0 * _KB, 100 * _KB, 500 * _KB, 1.0 * _MB, 2.5 * _MB, 5.0 * _MB, 10.0 * _MB}
+
+// bucketsOrDefault returns buckets, or defaultBuckets when buckets is empty
+func bucketsOrDefault(buckets, defaultBuckets []float64) []float64 {
+	if len(buckets) == 0 {
+		return defaultBuckets
+	}
+	return buckets
+}
 
 /*
 RequestCounterLabelMappingFunc is a function which can be supplied to the middleware to control
@@ -56,10 +114,10 @@ For instance, if for a "/customer/:name" route you don't want to generate a time
 possible customer name, you could use this function:
 
 	func(c echo.Context) string {
-		url := c.Request.URL.Path
-		for _, p := range c.Params {
-			if p.Key == "name" {
-				url = strings.Replace(url, p.Value, ":name", 1)
+		url := c.Request().URL.Path
+		for i, name := range c.ParamNames() {
+			if name == "name" {
+				url = strings.Replace(url, c.ParamValues()[i], ":name", 1)
 				break
 			}
 		}
@@ -67,31 +125,453 @@ possible customer name, you could use this function:
 	}
 
 which would map "/customer/alice" and "/customer/bob" to their template "/customer/:name".
+The default, c.Path(), is already the route template of the matched route.
 It can also be applied for the "Host" label
+
+Used as MiddlewareConfig.RequestCounterURLLabelMappingFunc, it sets the http.route of all the instruments
+and it runs after the handler. Returning "" skips recording the request entirely (the active requests gauge
+still counts it while in flight), a finer per-route opt-out than the Skipper. It is not called with
+MiddlewareConfig.URLLabelFromContext, which takes precedence.
 */
 type RequestCounterLabelMappingFunc func(c echo.Context) string
 
+// RouteLabelBehavior controls how requests which usually match odd routes or none
+// (CORS preflight OPTIONS and CONNECT requests) are recorded.
+type RouteLabelBehavior int
+
+const (
+	// RouteLabelAsIs records the request with its regular route label. This is the default.
+	RouteLabelAsIs RouteLabelBehavior = iota
+	// RouteLabelCollapse records the request with a dedicated route label, `<preflight>` or `<connect>`.
+	RouteLabelCollapse
+	// RouteLabelSkip does not record the request at all.
+	RouteLabelSkip
+)
+
+// WebSocketMode controls how the duration of WebSocket connections, which last as long as the connection, is recorded.
+type WebSocketMode int
+
+const (
+	// WebSocketRecordDuration records upgraded connections in the duration histograms like any request. This is the default.
+	WebSocketRecordDuration WebSocketMode = iota
+	// WebSocketSkipDuration keeps upgraded connections out of the duration histograms.
+	WebSocketSkipDuration
+	// WebSocketCountConnections keeps upgraded connections out of the duration histograms
+	// and counts them in `http.server.websocket.connections` instead.
+	WebSocketCountConnections
+)
+
+const (
+	preflightRouteLabel   = "<preflight>"
+	connectRouteLabel     = "<connect>"
+	preRejectedRouteLabel = "<pre-rejected>"
+	otherRouteLabel       = "<other>"
+	overflowRouteLabel    = "__overflow__"
+)
+
+// preRoutedContextKey is the context key PreMiddleware uses to learn from Middleware that the request got routed
+const preRoutedContextKey = "echootelmetrics.pre_routed"
+
+const (
+	endpointTypeREST      = "rest"
+	endpointTypeStream    = "stream"
+	endpointTypeWebSocket = "websocket"
+)
+
 // MiddlewareConfig contains the configuration for creating prometheus middleware collecting several default metrics.
 type MiddlewareConfig struct {
 	// Skipper defines a function to skip middleware.
 	Skipper middleware.Skipper
 
+	// IgnorePaths are path.Match glob patterns of requests to skip, e.g. "/healthz" or "/static/*".
+	// They are matched against the route template c.Path(), or the request URL path for unmatched requests.
+	// A request is skipped when either Skipper or any of the patterns matches.
+	IgnorePaths []string
+
+	// MetricsPath is the path the ExporterHandler is served on, defaults to "/metrics".
+	// The scrapes are not recorded, see IncludeMetricsEndpoint.
+	MetricsPath string
+
+	// IncludeMetricsEndpoint records the requests to MetricsPath like any other request, so the latency and
+	// size of the scrapes can be monitored. It is off by default to keep the scrapes out of their own output.
+	IncludeMetricsEndpoint bool
+
+	// EnableResetEndpoint makes Setup also register `POST <MetricsPath>/reset`, which restarts all the
+	// metrics from zero (see ResetHandler), e.g. between load test runs. Do not expose it in production:
+	// Prometheus sees a counter reset, which rate() and increase() handle but raw values do not.
+	EnableResetEndpoint bool
+
+	// ListenAddress and MetricsRouter make Setup serve the metrics routes on a separate Echo instead of
+	// the instrumented one, e.g. on a private port which stays out of the public access log.
+	// The MetricsRouter defaults to a new Echo. When ListenAddress is set, Setup starts the router on it
+	// and stops it when the instrumented Echo shuts down. Otherwise starting the MetricsRouter is up to the caller.
+	ListenAddress string
+	MetricsRouter *echo.Echo
+
 	ServiceName    string
 	ServiceVersion string
 
+	// SetGlobalProvider controls whether the MeterProvider created by New is installed with otel.SetMeterProvider.
+	// Nil means true. Set it to false to run several independent Metrics (e.g. for two Echo apps) in one process,
+	// each one keeps its provider local and Meter should be used for custom instruments.
+	SetGlobalProvider *bool
+
+	// NormalizeMethods records the requests with a method outside of the standard set (GET, POST, PUT, DELETE,
+	// PATCH, HEAD, OPTIONS, TRACE and CONNECT) with http.request.method="_OTHER", as the semconv requires,
+	// so clients sending arbitrary methods can not create new series. Nil means true.
+	NormalizeMethods *bool
+
 	// Namespace is components of the fully-qualified name of the Metric (created by joining Namespace,Subsystem and Name components with "_")
 	// this will take from ServiceName if not set
+	// Chars outside `[a-zA-Z0-9_]` are replaced with `_` and a leading digit gets a `_` prefix,
+	// the change is reported to the otel error handler.
 	// Optional
 	Namespace string
 
+	// ResourceAttributes are added to the resource next to service.name, service.version and
+	// service.namespace, e.g. deployment.environment or host.name. They win over those three.
+	// Optional
+	ResourceAttributes []attribute.KeyValue
+
+	// Resource replaces the resource built from resource.Default, the service fields and the ResourceAttributes.
+	// Optional
+	Resource *resource.Resource
+
+	// MetricPrefix is an extra prefix put in front of the Namespace, e.g. a team name.
+	// The exported metric names are built as `<MetricPrefix>_<Namespace>_<name>`,
+	// so MetricPrefix "teamx" and Namespace "myservice" yield `teamx_myservice_requests_total`.
+	// Both parts are sanitized the same way ("-" is replaced by "_").
+	// Optional
+	MetricPrefix string
+
+	// EnableServerAddrPort adds the server.address and server.port attributes.
 	EnableServerAddrPort bool
 
+	// WithServerPort adds the server.port attribute without server.address.
+	// When the request Host has no explicit port, it falls back to 80 or 443 based on url.scheme.
+	WithServerPort bool
+
+	// NotFoundPathSegments groups unmatched (404) requests by the first segment of their path,
+	// instead of collapsing all of them into http.route="". Segments in this allowlist are used as-is
+	// for the route label (e.g. "wp-admin" for "/wp-admin/setup.php"), the others are grouped as "<other>".
+	NotFoundPathSegments []string
+
+	// MaxRouteCardinality caps the number of distinct http.route values, e.g. when a RouteNormalizer or a
+	// RequestCounterURLLabelMappingFunc derives the route from the raw path and attackers hit random paths.
+	// Once the cap is reached, the requests of any new route are recorded with http.route="__overflow__",
+	// the routes recorded before keep their label until Reload. It is enforced by the middleware, as an SDK
+	// view attribute filter can only drop the http.route attribute, not rewrite its value. Optional
+	MaxRouteCardinality int
+
+	// UnmatchedRouteLabel replaces the empty http.route of requests that did not match any route.
+	// Catch-alls registered with e.Any("/*") or e.RouteNotFound("/*") are matched routes,
+	// their requests are labeled with the registered pattern, e.g. "/*" or "/api/*".
+	// Optional, defaults to "".
+	UnmatchedRouteLabel string
+
+	// RouteNormalizer, if set, derives the http.route of unmatched requests from the raw URL path,
+	// e.g. to tell "/favicon.ico" apart from other 404s. It must keep the cardinality bounded,
+	// NormalizeRoutePath strips the query and collapses numeric segments.
+	// It takes precedence over UnmatchedRouteLabel, NotFoundPathSegments takes precedence over both.
+	RouteNormalizer func(path string) string
+
+	// PreflightRouteLabel controls how CORS preflight requests
+	// (OPTIONS requests carrying an Access-Control-Request-Method header) are recorded.
+	PreflightRouteLabel RouteLabelBehavior
+
+	// ConnectRouteLabel controls how CONNECT requests are recorded.
+	ConnectRouteLabel RouteLabelBehavior
+
+	// DurationBuckets, RequestSizeBuckets and ResponseSizeBuckets replace the default histogram bucket boundaries
+	// of the request duration (in seconds), request body size and response body size (in bytes) histograms.
+	// Nil or empty keeps the defaults.
+	DurationBuckets     []float64
+	RequestSizeBuckets  []float64
+	ResponseSizeBuckets []float64
+
+	// MetricNames overrides the names of the request duration, request counter, active requests
+	// and body size instruments. Optional, defaults to the semconv names.
+	MetricNames MetricNames
+
+	// DurationUnit is the unit of the request duration histogram, "s" (the default) or "ms" for dashboards
+	// and alert rules built on the older `otelmetric` package, which exports it as
+	// `http_server_request_duration_milliseconds` with the default buckets in milliseconds.
+	// DurationBuckets are in this unit too. The other duration histograms stay in seconds, the DurationBuckets
+	// they reuse (time to first byte, trimmed and bind durations) are converted to seconds.
+	DurationUnit string
+
+	// RequestSizeFunc replaces the built-in request size approximation (URL, method, proto, headers, host
+	// and ContentLength, or the bytes read by the handler for chunked bodies) recorded by the request body
+	// size histogram, e.g. to count only the body bytes.
+	// It runs before the handler. Optional
+	RequestSizeFunc func(r *http.Request) int
+
+	// WriteTimeout is a hint of the http.Server WriteTimeout, which the middleware can not observe.
+	// When set, a response write failing once the request ran for about that long is counted as
+	// a timed out response in `http.server.write_timeout`. Optional
+	WriteTimeout time.Duration
+
+	// UncompressedCompressibleThreshold counts the responses larger than this many bytes with a compressible
+	// content type (text, JSON, XML, JavaScript...) which were sent without a Content-Encoding (or `identity`)
+	// in `http.server.response.uncompressed_compressible`, to find missed compression opportunities. Optional
+	UncompressedCompressibleThreshold int64
+
+	// DisableSizeMetrics skips the request and response body size histograms,
+	// which shrinks the exporter payload and saves computing the approximate request size.
+	DisableSizeMetrics bool
+
+	// TrimmedDurationThreshold, if set, records an extra `http.server.request.duration.trimmed` histogram
+	// where samples above the threshold are clamped to it, so a single runaway request does not dominate
+	// the `_sum` of dashboards. Clamped samples are counted in `http.server.request.duration.clamped`.
+	TrimmedDurationThreshold time.Duration
+
+	// WithLongDurationHistogram records the requests slower than LongDurationThreshold (500ms by default)
+	// in an extra `http.server.request.duration.long` histogram with buckets from 0.5s up to 5 minutes,
+	// for a high resolution on slow endpoints without adding buckets to the main histogram.
+	WithLongDurationHistogram bool
+	LongDurationThreshold     time.Duration
+
+	// WithTTFB records the time from the start of the request to the first byte of the response (the status
+	// line and headers, or the first body write) in `http.server.request.time_to_first_byte`, to tell slow
+	// handlers apart from slow clients on streaming responses. Hijacked connections are not recorded.
+	WithTTFB bool
+
+	// WithConcurrencyHistogram records the number of requests in flight (including the new one) at the start
+	// of each request in `http.server.concurrency`, the distribution capacity planning needs and which the
+	// active requests gauge can not provide between scrapes.
+	WithConcurrencyHistogram bool
+
+	// MinRecordedDuration is a floor the recorded request durations are raised to, e.g. 1µs, so handlers
+	// faster than the millisecond precision of the duration (or the clock granularity) are not recorded as
+	// zero-valued samples dominating the lowest bucket. Optional
+	MinRecordedDuration time.Duration
+
+	// ActiveRequestsNoAttributes records the active requests up/down counter without any attributes,
+	// which yields a single in-flight series and avoids building the attribute set twice per request.
+	ActiveRequestsNoAttributes bool
+
+	// WithActiveRequestRoute adds http.route to the active requests up/down counter, to see the in-flight
+	// requests per endpoint during incidents. The route is resolved before the handler runs, by the
+	// RouteTemplateResolver or the RequestCounterURLLabelMappingFunc, and the same value is used for the
+	// matching decrement. It is empty for the requests recorded by PreMiddleware, which run before routing.
+	WithActiveRequestRoute bool
+
 	RequestCounterURLLabelMappingFunc  RequestCounterLabelMappingFunc
 	RequestCounterHostLabelMappingFunc func(c echo.Context) (string, int)
 
+	// TrustForwardedHeaders takes server.address from X-Forwarded-Host, for apps behind a reverse proxy which
+	// would otherwise report the internal hop. Only enable it if the proxy overwrites the header: clients
+	// can send any value, spoofing the label and creating arbitrary series. Only the default host mapping
+	// is affected, a custom RequestCounterHostLabelMappingFunc is used as is. url.scheme comes from echo's
+	// Context.Scheme, which honors X-Forwarded-Proto and the like: without TrustForwardedHeaders a value other
+	// than "http" or "https" is replaced by the scheme of the connection, so it can not create series either.
+	TrustForwardedHeaders bool
+
+	// WithStatusClass adds the http.response.status_class attribute ("2xx", "3xx", "4xx", "5xx").
+	// To record only the class, add HttpResponseStatusCode to DisabledAttributes.
+	WithStatusClass bool
+
+	// WithProtocolVersion adds the network.protocol.name ("http") and network.protocol.version
+	// ("1.0", "1.1", "2", "3") attributes, e.g. to tell HTTP/2 traffic apart.
+	WithProtocolVersion bool
+
+	// RouteTemplateResolver, if set, is authoritative for the http.route label, for routers where
+	// c.Path() does not reflect the real route template (e.g. behind a path rewriting proxy layer).
+	// The precedence is: RouteTemplateResolver, then RequestCounterURLLabelMappingFunc, which defaults to c.Path().
+	// PreflightRouteLabel and ConnectRouteLabel still apply on top of it.
+	RouteTemplateResolver func(c echo.Context) string
+
+	// AdditionalAttributes, if set, returns extra attributes recorded on every instrument, e.g. business
+	// dimensions like a tenant or an API version. It runs after the handler, so it can read values set with c.Set.
+	// Returning nil is fine. Beware that every distinct value creates new series, keep the values bounded.
+	AdditionalAttributes func(c echo.Context) []attribute.KeyValue
+
+	// DisabledAttributes are attribute keys left out of every recorded instrument to reduce the number of series,
+	// e.g. ServerAddress or URLScheme. By default, all instruments record url.scheme, http.response.status_code,
+	// http.request.method and http.route, plus the attributes enabled by the other options.
+	DisabledAttributes []attribute.Key
+
+	// AttributeScrubber, if set, is applied to every string attribute value right before recording,
+	// as a final pass to redact sensitive values (tokens, emails, ...) a label mapping func may have let through.
+	AttributeScrubber func(key attribute.Key, value string) string
+
+	// WithRequestURLAndHeaderSize records the request URL length and the approximate header size
+	// into two dedicated histograms, which helps to detect abusive requests with enormous URLs or header sets.
+	WithRequestURLAndHeaderSize bool
+
+	// WithSetCookieCount records the number of Set-Cookie headers of each response into a histogram,
+	// an indicator for runaway session middleware bloating responses.
+	WithSetCookieCount bool
+
+	// WithTrailersAttribute adds a `has_trailers` attribute to the requests counter,
+	// telling whether the handler declared or sent any HTTP trailers.
+	WithTrailersAttribute bool
+
+	// WithSerializerAttribute adds a `response.serializer` attribute (json, xml, protobuf or other)
+	// to the requests counter, derived from the response Content-Type.
+	WithSerializerAttribute bool
+
+	// WithClientCertAttribute adds a `client.cert.present` attribute to the requests counter,
+	// telling whether the TLS client presented a certificate, e.g. to follow mTLS adoption.
+	WithClientCertAttribute bool
+
+	// WithBotAttribute adds a `client.is_bot` attribute to the requests counter, true when the
+	// User-Agent contains any of the BotUserAgentPatterns, to segment human and crawler traffic.
+	WithBotAttribute bool
+
+	// BotUserAgentPatterns are case-insensitive User-Agent substrings used by WithBotAttribute.
+	// Defaults to DefaultBotUserAgentPatterns.
+	BotUserAgentPatterns []string
+
+	// CacheResultHeader is the name of a response header (e.g. "X-Cache") from which a `cache.result`
+	// attribute (hit, miss or bypass) is derived and added to the requests counter.
+	// Optional, the attribute is only added when set.
+	CacheResultHeader string
+
+	// StreamingRoutes and WebSocketRoutes are route templates (as returned by c.Path()) which are
+	// classified as `stream` and `websocket` by the `endpoint_type` attribute on the requests counter.
+	// Other routes are classified as `rest`. The attribute is only added when any of the lists is set.
+	StreamingRoutes []string
+	WebSocketRoutes []string
+
+	// WithErrorCounter counts the 5xx responses in `http.server.errors`, labeled only by method and route,
+	// a cheap low-cardinality error signal for SLO burn-rate alerts. ErrorCounterIncludeClientErrors
+	// counts the 4xx responses as well.
+	WithErrorCounter                bool
+	ErrorCounterIncludeClientErrors bool
+
+	// WebSocketMode controls whether WebSocket connections, requests asking for `Upgrade: websocket` which were
+	// answered with 101 Switching Protocols or hijacked, are recorded in the duration histograms, where their
+	// connection lifetime pollutes the high buckets. The other metrics record them either way.
+	WebSocketMode WebSocketMode
+
+	// CounterSampleRoutes maps http.route values of ultra-high-QPS routes to a sample rate N:
+	// the requests counter of those routes is incremented by N once every N requests instead of
+	// by 1 on every request, which cuts the contention on the counter.
+	// The counter is approximate: it lags behind by up to N-1 requests, and each increment carries
+	// the attributes (status code, method...) of the request that triggered it. N <= 1 keeps the route exact.
+	CounterSampleRoutes map[string]int
+
+	// SampleRate, between 0 and 1, records the request duration and body size histograms for that random
+	// fraction of the requests only, to save the per request Record calls at very high RPS. The requests
+	// counter is still incremented on every request, so counts and rates stay accurate, but the histograms
+	// hold fewer samples: their `_count` and `_sum` undercount and the quantiles get less precise.
+	// 0 or 1 records every request. Optional
+	SampleRate float64
+
+	// LogicalErrorContextKey enables the `outcome` attribute (success or error) on the requests counter.
+	// The outcome is error for 5xx responses, or when a handler flags a logical failure by setting
+	// this context key (via c.Set) to true or to a non-nil error, even if the response status is 2xx.
+	LogicalErrorContextKey string
+
+	// BindDurationContextKey enables the `http.server.bind.duration` histogram: handlers report the time spent
+	// binding and validating the request by setting this context key (via c.Set) to a time.Duration or to
+	// float64 seconds. Requests which do not set it are not recorded.
+	BindDurationContextKey string
+
+	// URLLabelFromContext, like the legacy echo-contrib Prometheus middleware, replaces the http.route of every
+	// request by the value of this context key (set with c.Set), or "unknown" if the request did not set it.
+	// It takes precedence over the RouteTemplateResolver and the RequestCounterURLLabelMappingFunc. Optional
+	URLLabelFromContext string
+
+	// HandlerNameFromContext adds a `handler` attribute to the request metrics, taken from this context key
+	// (set with c.Set by the handler or a middleware), e.g. to group the versioned routes of one logical handler.
+	// It does not override http.route. Requests which do not set the key get no `handler` attribute.
+	HandlerNameFromContext string
+
+	// RecordAsync offloads the histogram and counter recordings to a background worker through a bounded buffer,
+	// keeping the request path minimal when the metrics SDK becomes a bottleneck under extreme load.
+	// Recordings are dropped and counted in `metrics.dropped` when the buffer is full.
+	// The active requests up/down counter is always recorded synchronously to stay accurate.
+	RecordAsync bool
+
+	// RecordAsyncBufferSize is the buffer size used by RecordAsync.
+	// Defaults to 1024.
+	RecordAsyncBufferSize int
+
+	// WithConfigInfo exposes a constant `echo_otel_metrics_config_info` gauge labeled with
+	// every boolean option of this config, to find misconfigured instances across a fleet.
+	WithConfigInfo bool
+
+	// WithRuntimeMetrics adds the Go runtime metrics (goroutines, GC, heap...) of
+	// go.opentelemetry.io/contrib/instrumentation/runtime to the middleware MeterProvider,
+	// so they are served by ExporterHandler next to the HTTP metrics.
+	WithRuntimeMetrics bool
+
+	// WithBuildInfo exposes a constant `http_server_build_info` gauge labeled with the ServiceVersion,
+	// the Go version and the VCS commit of the binary, to correlate dashboards with deploys.
+	WithBuildInfo bool
+
+	// WithTraceSampledAttribute adds a `trace_sampled` attribute to the request duration histogram,
+	// telling whether the span of the request context is sampled, to compare the latency of sampled
+	// and unsampled traffic. A cheaper alternative to WithExemplars, it only has 2 values.
+	WithTraceSampledAttribute bool
+
+	// PromoteInstanceLabel copies the service.instance.id resource attribute (e.g. set via ResourceAttributes
+	// or OTEL_RESOURCE_ATTRIBUTES, falling back to the hostname) onto the HTTP metrics as a `service_instance_id`
+	// label, for dashboards which do not join target_info. Every instance gets its own series, which multiplies
+	// the cardinality across a large fleet.
+	PromoteInstanceLabel bool
+
+	// WithExemplars attaches the trace_id and span_id of the sampled span of the request context as exemplars
+	// to the request duration histogram and the other request metrics, so dashboards can jump from a latency
+	// bucket to the trace. The Prometheus exporter only serves exemplars in the OpenMetrics format,
+	// which ExporterHandler then negotiates, see EnableOpenMetrics. Exemplars are lost with RecordAsync.
+	WithExemplars bool
+
+	// EnableOpenMetrics makes ExporterHandler serve the OpenMetrics format (with the exemplars and the counter
+	// `_total` suffix it requires) to the scrapers sending `Accept: application/openmetrics-text`, others still get
+	// the text format. It is implied by WithExemplars.
+	EnableOpenMetrics bool
+
 	// if enabled, it will add the scope information (otel_scope_name="otelmetric-demo",otel_scope_version="") to every metrics
 	WithScopeInfo bool
 
+	// ScopeName and ScopeVersion set the instrumentation scope of the middleware meter (and of Meter),
+	// which WithScopeInfo exposes as the otel_scope_name and otel_scope_version labels. ScopeName defaults to "echo".
+	ScopeName    string
+	ScopeVersion string
+
+	// WithoutTargetInfo drops the `target_info` metric carrying the resource attributes from the Prometheus output.
+	WithoutTargetInfo bool
+
+	// Views customize the streams of the instruments, of the middleware or created with Meter, e.g. to drop
+	// attributes on specific instruments or to rename them. The SDK applies every view matching an instrument,
+	// each one producing its own stream, so overlapping views yield duplicate metrics; an instrument matched by
+	// no view keeps its default stream. Optional
+	Views []sdkmetric.View
+
+	// WithoutUnits stops the Prometheus exporter from appending the unit suffixes, for dashboards built
+	// on the older names: `http_server_request_duration_seconds` becomes `http_server_request_duration`,
+	// `http_server_request_body_size_bytes` becomes `http_server_request_body_size` (likewise for the other
+	// `_bytes` histograms, `_seconds` histograms and the `_ratio` gauge). The `_total` suffix of counters is kept,
+	// see WithoutCounterSuffixes.
+	WithoutUnits bool
+
+	// WithoutCounterSuffixes stops the Prometheus exporter from appending `_total` to counters:
+	// `requests_total` becomes `requests`. It is independent of WithoutUnits, a counter with a unit
+	// keeps its unit suffix. Note that the OpenMetrics format requires the `_total` suffix on counters.
+	WithoutCounterSuffixes bool
+
+	// ExporterKind selects the exporter, Prometheus pull (the default) or OTLP push.
+	// With OTLP, ExporterHandler responds with 404 Not Found.
+	ExporterKind ExporterKind
+
+	// Reader is a pre-built reader wired into the MeterProvider instead of the one selected by ExporterKind.
+	// With a custom Reader, ExporterHandler responds with 404 Not Found. A reader can only be registered
+	// with one MeterProvider, Reload needs a new one (Reset fails with ErrReaderInUse).
+	// Optional
+	Reader sdkmetric.Reader
+
+	// Temporality selects cumulative (the default) or delta sums and histograms for the OTLP exporters.
+	// The Prometheus exporter requires cumulative, New returns an error for delta. A custom Reader
+	// sets its own, see Temporality.TemporalitySelector.
+	Temporality Temporality
+
+	// PushInterval is the interval of the periodic reader used by the OTLP exporters.
+	// Defaults to the OTEL_METRIC_EXPORT_INTERVAL environment variable or 60s.
+	PushInterval time.Duration
+
 	// Registry is the prometheus registry that will be used as the default Registerer and
 	// Gatherer if these are not specified.
 	Registry *realprometheus.Registry
@@ -103,6 +583,56 @@ type MiddlewareConfig struct {
 	// Gatherer is the prometheus gatherer to gather metrics with.
 	// If not specified the Registry will be used as default.
 	Gatherer realprometheus.Gatherer
+
+	// MetricsErrorAsJSON makes ExporterHandler respond with a JSON body `{"error": "..."}`
+	// instead of the plain text promhttp error when serving the metrics fails.
+	MetricsErrorAsJSON bool
+
+	// HandlerErrorHandling defines how ExporterHandler handles errors of the Gatherer (e.g. a failing collector):
+	// promhttp.HTTPErrorOnError (the default) responds with a 500, promhttp.ContinueOnError serves the metrics
+	// gathered anyway and promhttp.PanicOnError panics.
+	HandlerErrorHandling promhttp.HandlerErrorHandling
+
+	// ErrorLog receives the errors of ExporterHandler, e.g. the gather errors which HandlerErrorHandling
+	// would otherwise turn into a terse response only. Optional
+	ErrorLog promhttp.Logger
+
+	// MetricsAuth requires HTTP basic auth with these credentials on ExporterHandler and ResetHandler,
+	// which respond with 401 Unauthorized otherwise. Optional
+	MetricsAuth *BasicAuth
+
+	// MetricsAuthorizer reports whether a request to ExporterHandler or ResetHandler is allowed, e.g. by
+	// checking a bearer token. With MetricsAuth as well, a request passing either check is allowed. Optional
+	MetricsAuthorizer func(c echo.Context) bool
+
+	// MaxScrapeBytes is a safety limit for the size of the scrape response written by ExporterHandler.
+	// The response is held back up to the limit, a scrape exceeding it is answered with a 500 error
+	// (JSON with MetricsErrorAsJSON) and logged with the echo logger, so the scraper does not ingest a
+	// partial payload. The limit applies to the bytes on the wire, i.e. after compression.
+	// Optional
+	MaxScrapeBytes int
+
+	// DisableCompression stops ExporterHandler from gzip (or zstd) compressing the scrape response
+	// for the scrapers sending a matching Accept-Encoding, e.g. when a proxy in front compresses already.
+	DisableCompression bool
+
+	// ExportFilter reports whether a metric family, by its exported name (e.g. `http_server_response_body_size_bytes`),
+	// is served by ExporterHandler. It runs on every scrape, so it can be toggled at runtime.
+	// The instruments are still recorded and the Gatherer itself is not filtered.
+	// Optional
+	ExportFilter func(metricName string) bool
+
+	// NameSanitizer rewrites the metric family names (e.g. `requests_total`) and the label names
+	// served by ExporterHandler, to follow the naming rules of a backend or of an organization.
+	// It runs after ExportFilter. The `_bucket`, `_sum` and `_count` suffixes of histograms and
+	// the `le` label are appended to the sanitized name by the encoder. Optional
+	NameSanitizer func(name string) string
+}
+
+// counterSample counts the requests of a sampled route, see MiddlewareConfig.CounterSampleRoutes
+type counterSample struct {
+	every int64
+	seen  atomic.Int64
 }
 
 // Metrics contains the metrics gathered by the instance and its path
@@ -114,15 +644,154 @@ type Metrics struct {
 	reqSize     metric.Int64Histogram
 	resSize     metric.Int64Histogram
 
+	reqURLLength  metric.Int64Histogram
+	reqHeaderSize metric.Int64Histogram
+
+	setCookieCount metric.Int64Histogram
+
+	concurrency metric.Int64Histogram
+	// inFlight mirrors activeRequests for the concurrency histogram, the up/down counter can not be read
+	inFlight atomic.Int64
+
+	trimmedReqDuration metric.Float64Histogram
+	longReqDuration    metric.Float64Histogram
+	timeToFirstByte    metric.Float64Histogram
+	clampedReqDuration metric.Int64Counter
+
+	bindDuration metric.Float64Histogram
+
+	// instanceID is the service.instance.id promoted by MiddlewareConfig.PromoteInstanceLabel
+	instanceID string
+
+	// provider is the MeterProvider set up by the middleware
+	provider *sdkmetric.MeterProvider
+
+	requestsNotReady  metric.Int64Counter
+	bodyLimitRejected metric.Int64Counter
+	writeTimeouts     metric.Int64Counter
+
+	uncompressedCompressible metric.Int64Counter
+	webSocketConnections     metric.Int64Counter
+	serverErrors             metric.Int64Counter
+
+	// collector forwards the Registerer to the exporter collector
+	collector *reloadableCollector
+
+	// reloaded is the instance built by the last Reload, which serves the requests from then on
+	reloaded atomic.Pointer[Metrics]
+	reloadMu sync.Mutex
+
+	// optedOutRoutes caches whether a "METHOD path" route is marked with SkipRouteMetrics, the method
+	// is normalized so the client can not grow it with arbitrary methods
+	optedOutRoutes sync.Map
+
+	// notReady is flipped by SetReady, the zero value means ready
+	notReady atomic.Bool
+
+	// notFoundPathSegments is the set of MiddlewareConfig.NotFoundPathSegments
+	notFoundPathSegments map[string]struct{}
+
+	// disabledAttributes is the set of MiddlewareConfig.DisabledAttributes
+	disabledAttributes map[attribute.Key]struct{}
+
+	// endpointTypes maps route templates to their endpoint_type
+	endpointTypes map[string]string
+
+	// botUserAgentPatterns are the lower-cased MiddlewareConfig.BotUserAgentPatterns
+	botUserAgentPatterns []string
+
+	// customURLLabelMapping is set when MiddlewareConfig.RequestCounterURLLabelMappingFunc is not the default one
+	customURLLabelMapping bool
+
+	// seenRoutes is the set of route labels recorded so far, bounded by MiddlewareConfig.MaxRouteCardinality
+	seenRoutes     sync.Map
+	seenRoutesMu   sync.Mutex
+	seenRouteCount int
+
+	// counterSamples holds the per route state of MiddlewareConfig.CounterSampleRoutes
+	counterSamples map[string]*counterSample
+
+	// routeConcurrency holds the routes registered with RegisterRouteConcurrency
+	routeConcurrency *routeConcurrencyLimits
+
+	// workerPools holds the pools registered with RegisterWorkerPool
+	workerPools *workerPools
+
+	records        chan func(ctx context.Context)
+	droppedRecords metric.Int64Counter
+	// recordsMu guards records against the close by stopRecordWorker, once Reload replaced the instance
+	recordsMu     sync.RWMutex
+	recordsClosed bool
+	// recordsDone is closed when the recordWorker has run the remaining records and exited
+	recordsDone chan struct{}
+
 	*MiddlewareConfig
 }
 
-// New generates a new set of metrics with a certain subsystem name
+// New generates a new set of metrics with a certain subsystem name.
+// It panics if the metrics can not be set up, use NewWithError to handle the error instead.
 func New(config MiddlewareConfig) *Metrics {
+	p, err := NewWithError(config)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// NewWithError generates a new set of metrics with a certain subsystem name,
+// returning an error instead of panicking if the instruments or the exporter can not be set up.
+func NewWithError(config MiddlewareConfig) (*Metrics, error) {
+	return newMetrics(config, nil)
+}
+
+// newMetrics implements NewWithError, old is the instance being reloaded if any. The state carried over
+// from old is set before the exporter is handed to its collector, a scrape may run the new callbacks right away.
+func newMetrics(config MiddlewareConfig, old *Metrics) (*Metrics, error) {
 	if config.Skipper == nil {
 		config.Skipper = middleware.DefaultSkipper
 	}
 
+	for _, pattern := range config.IgnorePaths {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid IgnorePaths pattern %q: %w", pattern, err)
+		}
+	}
+
+	if config.MetricsPath == "" {
+		config.MetricsPath = defaultMetricsPath
+	}
+
+	config.MetricNames = config.MetricNames.withDefaults()
+	if err := config.MetricNames.validate(); err != nil {
+		return nil, err
+	}
+
+	switch config.DurationUnit {
+	case "":
+		config.DurationUnit = unitSeconds
+	case unitSeconds, unitMilliseconds:
+	default:
+		return nil, fmt.Errorf("invalid DurationUnit %q, must be %q or %q", config.DurationUnit, unitSeconds, unitMilliseconds)
+	}
+
+	switch config.Temporality {
+	case TemporalityCumulative:
+	case TemporalityDelta:
+		if config.Reader == nil && config.ExporterKind == ExporterPrometheus {
+			return nil, fmt.Errorf("%s temporality is not supported by the %s exporter", config.Temporality, config.ExporterKind)
+		}
+	default:
+		return nil, fmt.Errorf("invalid Temporality %s", config.Temporality)
+	}
+
+	if config.SampleRate < 0 || config.SampleRate > 1 {
+		return nil, fmt.Errorf("invalid SampleRate %v, must be between 0 and 1", config.SampleRate)
+	}
+
+	if config.ScopeName == "" {
+		config.ScopeName = defaultScopeName
+	}
+
 	if config.Registry != nil {
 		config.Registerer = config.Registry
 		config.Gatherer = config.Registry
@@ -135,22 +804,30 @@ func New(config MiddlewareConfig) *Metrics {
 		config.Gatherer = realprometheus.DefaultGatherer
 	}
 
+	// only a custom mapping func can skip requests, the default one returns "" for unmatched requests.
+	// The default one is back in the config of Reset (or any Reload of Config), it is not custom then either.
+	customURLLabelMapping := config.RequestCounterURLLabelMappingFunc != nil &&
+		reflect.ValueOf(config.RequestCounterURLLabelMappingFunc).Pointer() != reflect.ValueOf(defaultURLLabelMapping).Pointer()
 	if config.RequestCounterURLLabelMappingFunc == nil {
-		config.RequestCounterURLLabelMappingFunc = func(c echo.Context) string {
-			// contains route path ala `/users/:id`
-			// as of Echo v4.10.1 path is empty for 404 cases (when router did not find any matching routes)
-			return c.Path()
-		}
+		config.RequestCounterURLLabelMappingFunc = defaultURLLabelMapping
 	}
 
 	if config.RequestCounterHostLabelMappingFunc == nil {
+		trustForwardedHeaders := config.TrustForwardedHeaders
 		config.RequestCounterHostLabelMappingFunc = func(c echo.Context) (string, int) {
-			if c.Request().Host == "" {
+			hostPort := c.Request().Host
+			if trustForwardedHeaders {
+				// the first value is the host the client asked the outermost proxy for
+				if forwarded, _, _ := strings.Cut(c.Request().Header.Get("X-Forwarded-Host"), ","); forwarded != "" {
+					hostPort = strings.TrimSpace(forwarded)
+				}
+			}
+			if hostPort == "" {
 				return "", 0
 			}
-			host, port, err := net.SplitHostPort(c.Request().Host)
+			host, port, err := net.SplitHostPort(hostPort)
 			if err != nil {
-				return c.Request().Host, 0
+				return hostPort, 0
 			}
 			portInt, _ := strconv.Atoi(port)
 			return host, portInt
@@ -158,16 +835,35 @@ func New(config MiddlewareConfig) *Metrics {
 	}
 
 	p := &Metrics{
-		MiddlewareConfig: &config,
+		MiddlewareConfig:      &config,
+		customURLLabelMapping: customURLLabelMapping,
+	}
+	if old != nil {
+		if collector := old.collector; collector != nil && collector.registerer == config.Registerer && !collector.unregistered.Load() {
+			p.collector = collector
+		}
+		p.routeConcurrency = old.routeConcurrency
+		p.workerPools = old.workerPools
+	} else {
+		p.routeConcurrency = &routeConcurrencyLimits{}
+		p.workerPools = &workerPools{}
+	}
+
+	// the provider must exist before the instruments are created, a package level meter
+	// would stay bound to whichever global provider was installed first
+	if _, err := p.initMetricsMeterProvider(); err != nil {
+		return nil, err
 	}
+	meter := p.meter()
 
 	var err error
 	// Standard default metrics
 	p.requests, err = meter.Int64Counter(
 		// the result name is `requests_total`
 		// https://github.com/open-telemetry/opentelemetry-go/blob/46f2ce5ca6adaa264c37cdbba251c9184a06ed7f/exporters/prometheus/exporter.go#L74
-		// the exporter will enforce the `_total` suffix for counter, so we do not need it here
-		"requests",
+		// the exporter will enforce the `_total` suffix for counter, so we do not need it here,
+		// unless MiddlewareConfig.WithoutCounterSuffixes is set
+		config.MetricNames.Requests,
 		// see https://github.com/open-telemetry/opentelemetry-go/pull/3776
 		// The go.opentelemetry.io/otel/metric/unit package is deprecated. Setup the equivalent unit string instead. (#3776)
 		// Setup "1" instead of unit.Dimensionless
@@ -182,200 +878,1393 @@ func New(config MiddlewareConfig) *Metrics {
 		//		"By": "_bytes",
 		//		"ms": "_milliseconds",
 		//	}
-		// disable this behaviour by using `prometheus.WithoutUnits()` option
+		// disable this behaviour by using `prometheus.WithoutUnits()` option (MiddlewareConfig.WithoutUnits)
+		// the unit suffix is appended before the `_total` suffix, they are toggled independently
 		// or hack: do not set unit for counter to avoid the `_ratio` suffix
 		metric.WithDescription("How many HTTP requests processed, partitioned by status code and HTTP method."),
 	)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to create %s counter: %w", config.MetricNames.Requests, err)
 	}
 
-	p.activeRequests, err = meter.Int64UpDownCounter(
-		MetricHTTPServerActiveRequests,
-		metric.WithDescription("Number of active HTTP server requests."),
+	p.requestsNotReady, err = meter.Int64Counter(
+		MetricHTTPServerRequestsNotReady,
+		metric.WithDescription("How many HTTP requests were handled while the app was marked not ready."),
 	)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to create %s counter: %w", MetricHTTPServerRequestsNotReady, err)
 	}
 
-	p.reqDuration, err = meter.Float64Histogram(
-		MetricHTTPServerRequestDuration,
-		metric.WithUnit("s"),
-		metric.WithDescription("Duration of HTTP server requests in seconds."),
-		metric.WithExplicitBucketBoundaries(reqDurBucketsSeconds...),
+	p.bodyLimitRejected, err = meter.Int64Counter(
+		MetricHTTPServerBodyLimitRejected,
+		metric.WithDescription("How many HTTP requests were rejected with 413, e.g. by middleware.BodyLimit."),
 	)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to create %s counter: %w", MetricHTTPServerBodyLimitRejected, err)
 	}
 
-	p.reqSize, err = meter.Int64Histogram(
-		MetricHTTPServerRequestBodySize,
-		metric.WithUnit(unitBytes),
-		metric.WithDescription("Size of HTTP server request bodies."),
-		metric.WithExplicitBucketBoundaries(byteBuckets...),
+	if config.WriteTimeout > 0 {
+		p.writeTimeouts, err = meter.Int64Counter(
+			MetricHTTPServerWriteTimeout,
+			metric.WithDescription("How many HTTP responses were aborted by the server write timeout."),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s counter: %w", MetricHTTPServerWriteTimeout, err)
+		}
+	}
+
+	if config.WithErrorCounter {
+		p.serverErrors, err = meter.Int64Counter(
+			MetricHTTPServerErrors,
+			metric.WithDescription("How many HTTP requests failed with a server error, partitioned by HTTP method and route."),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s counter: %w", MetricHTTPServerErrors, err)
+		}
+	}
+
+	if config.WebSocketMode == WebSocketCountConnections {
+		p.webSocketConnections, err = meter.Int64Counter(
+			MetricHTTPServerWebSocketConnections,
+			metric.WithDescription("How many WebSocket connections were upgraded by the HTTP server."),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s counter: %w", MetricHTTPServerWebSocketConnections, err)
+		}
+	}
+
+	if config.UncompressedCompressibleThreshold > 0 {
+		p.uncompressedCompressible, err = meter.Int64Counter(
+			MetricHTTPServerResponseUncompressedCompressible,
+			metric.WithDescription("How many HTTP responses with a compressible content type were sent uncompressed."),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s counter: %w", MetricHTTPServerResponseUncompressedCompressible, err)
+		}
+	}
+
+	p.activeRequests, err = meter.Int64UpDownCounter(
+		config.MetricNames.ActiveRequests,
+		metric.WithDescription("Number of active HTTP server requests."),
 	)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to create %s up/down counter: %w", config.MetricNames.ActiveRequests, err)
 	}
 
-	p.resSize, err = meter.Int64Histogram(
-		MetricHTTPServerResponseBodySize,
-		metric.WithUnit(unitBytes),
-		metric.WithDescription("Size of HTTP server response bodies."),
-		metric.WithExplicitBucketBoundaries(byteBuckets...),
+	reqDurDescription, reqDurBuckets := "Duration of HTTP server requests in seconds.", DefaultDurationBuckets
+	if config.DurationUnit == unitMilliseconds {
+		reqDurDescription, reqDurBuckets = "Duration of HTTP server requests in milliseconds.", reqDurBucketsMilliseconds
+	}
+	p.reqDuration, err = meter.Float64Histogram(
+		config.MetricNames.RequestDuration,
+		metric.WithUnit(config.DurationUnit),
+		metric.WithDescription(reqDurDescription),
+		metric.WithExplicitBucketBoundaries(bucketsOrDefault(config.DurationBuckets, reqDurBuckets)...),
 	)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to create %s histogram: %w", config.MetricNames.RequestDuration, err)
 	}
 
-	p.initMetricsMeterProvider()
-	return p
+	if !config.DisableSizeMetrics {
+		p.reqSize, err = meter.Int64Histogram(
+			config.MetricNames.RequestBodySize,
+			metric.WithUnit(unitBytes),
+			metric.WithDescription("Size of HTTP server request bodies."),
+			metric.WithExplicitBucketBoundaries(bucketsOrDefault(config.RequestSizeBuckets, DefaultSizeBuckets)...),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s histogram: %w", config.MetricNames.RequestBodySize, err)
+		}
+
+		p.resSize, err = meter.Int64Histogram(
+			config.MetricNames.ResponseBodySize,
+			metric.WithUnit(unitBytes),
+			metric.WithDescription("Size of HTTP server response bodies."),
+			metric.WithExplicitBucketBoundaries(bucketsOrDefault(config.ResponseSizeBuckets, DefaultSizeBuckets)...),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s histogram: %w", config.MetricNames.ResponseBodySize, err)
+		}
+	}
+
+	if config.WithRequestURLAndHeaderSize {
+		p.reqURLLength, err = meter.Int64Histogram(
+			MetricHTTPServerRequestURLLength,
+			metric.WithUnit(unitBytes),
+			metric.WithDescription("Length of HTTP server request URLs."),
+			metric.WithExplicitBucketBoundaries(headerBytesBuckets...),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s histogram: %w", MetricHTTPServerRequestURLLength, err)
+		}
+
+		p.reqHeaderSize, err = meter.Int64Histogram(
+			MetricHTTPServerRequestHeaderSize,
+			metric.WithUnit(unitBytes),
+			metric.WithDescription("Approximate size of HTTP server request headers."),
+			metric.WithExplicitBucketBoundaries(headerBytesBuckets...),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s histogram: %w", MetricHTTPServerRequestHeaderSize, err)
+		}
+	}
+
+	// the other duration histograms record seconds whatever the DurationUnit, the DurationBuckets are converted
+	secondsBuckets := DefaultDurationBuckets
+	if len(config.DurationBuckets) > 0 {
+		secondsBuckets = config.DurationBuckets
+		if config.DurationUnit == unitMilliseconds {
+			secondsBuckets = make([]float64, len(config.DurationBuckets))
+			for i, bucket := range config.DurationBuckets {
+				secondsBuckets[i] = bucket / 1000
+			}
+		}
+	}
+
+	if config.WithTTFB {
+		p.timeToFirstByte, err = meter.Float64Histogram(
+			MetricHTTPServerRequestTimeToFirstByte,
+			metric.WithUnit(unitSeconds),
+			metric.WithDescription("Time from the start of HTTP server requests to the first byte of the response in seconds."),
+			metric.WithExplicitBucketBoundaries(secondsBuckets...),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s histogram: %w", MetricHTTPServerRequestTimeToFirstByte, err)
+		}
+	}
+
+	if config.WithConcurrencyHistogram {
+		p.concurrency, err = meter.Int64Histogram(
+			MetricHTTPServerConcurrency,
+			metric.WithDescription("Number of HTTP server requests in flight at the start of a request."),
+			metric.WithExplicitBucketBoundaries(concurrencyBuckets...),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s histogram: %w", MetricHTTPServerConcurrency, err)
+		}
+	}
+
+	if config.WithLongDurationHistogram {
+		if config.LongDurationThreshold <= 0 {
+			config.LongDurationThreshold = defaultLongDurationThreshold
+		}
+		p.longReqDuration, err = meter.Float64Histogram(
+			MetricHTTPServerRequestDurationLong,
+			metric.WithUnit(unitSeconds),
+			metric.WithDescription("Duration of slow HTTP server requests in seconds."),
+			metric.WithExplicitBucketBoundaries(longDurationBucketsSeconds...),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s histogram: %w", MetricHTTPServerRequestDurationLong, err)
+		}
+	}
+
+	if config.TrimmedDurationThreshold > 0 {
+		p.trimmedReqDuration, err = meter.Float64Histogram(
+			MetricHTTPServerRequestDurationTrimmed,
+			metric.WithUnit("s"),
+			metric.WithDescription("Duration of HTTP server requests in seconds, clamped to the trimmed duration threshold."),
+			metric.WithExplicitBucketBoundaries(secondsBuckets...),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s histogram: %w", MetricHTTPServerRequestDurationTrimmed, err)
+		}
+
+		p.clampedReqDuration, err = meter.Int64Counter(
+			MetricHTTPServerRequestDurationClamped,
+			metric.WithDescription("Number of HTTP server request durations clamped in the trimmed duration histogram."),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s counter: %w", MetricHTTPServerRequestDurationClamped, err)
+		}
+	}
+
+	if config.BindDurationContextKey != "" {
+		p.bindDuration, err = meter.Float64Histogram(
+			MetricHTTPServerBindDuration,
+			metric.WithUnit("s"),
+			metric.WithDescription("Duration of HTTP server request binding and validation in seconds."),
+			metric.WithExplicitBucketBoundaries(secondsBuckets...),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s histogram: %w", MetricHTTPServerBindDuration, err)
+		}
+	}
+
+	if config.WithSetCookieCount {
+		p.setCookieCount, err = meter.Int64Histogram(
+			MetricHTTPServerResponseSetCookieCount,
+			metric.WithDescription("Number of Set-Cookie headers of HTTP server responses."),
+			metric.WithExplicitBucketBoundaries(setCookieCountBuckets...),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s histogram: %w", MetricHTTPServerResponseSetCookieCount, err)
+		}
+	}
+
+	if len(config.NotFoundPathSegments) > 0 {
+		p.notFoundPathSegments = make(map[string]struct{}, len(config.NotFoundPathSegments))
+		for _, segment := range config.NotFoundPathSegments {
+			p.notFoundPathSegments[segment] = struct{}{}
+		}
+	}
+
+	if len(config.DisabledAttributes) > 0 {
+		p.disabledAttributes = make(map[attribute.Key]struct{}, len(config.DisabledAttributes))
+		for _, key := range config.DisabledAttributes {
+			p.disabledAttributes[key] = struct{}{}
+		}
+	}
+
+	if config.WithBotAttribute {
+		if len(config.BotUserAgentPatterns) == 0 {
+			config.BotUserAgentPatterns = DefaultBotUserAgentPatterns
+		}
+		for _, pattern := range config.BotUserAgentPatterns {
+			p.botUserAgentPatterns = append(p.botUserAgentPatterns, strings.ToLower(pattern))
+		}
+	}
+
+	for route, every := range config.CounterSampleRoutes {
+		if every <= 1 {
+			continue
+		}
+		if p.counterSamples == nil {
+			p.counterSamples = make(map[string]*counterSample, len(config.CounterSampleRoutes))
+		}
+		p.counterSamples[route] = &counterSample{every: int64(every)}
+	}
+
+	if len(config.StreamingRoutes) > 0 || len(config.WebSocketRoutes) > 0 {
+		p.endpointTypes = make(map[string]string, len(config.StreamingRoutes)+len(config.WebSocketRoutes))
+		for _, route := range config.StreamingRoutes {
+			p.endpointTypes[route] = endpointTypeStream
+		}
+		for _, route := range config.WebSocketRoutes {
+			p.endpointTypes[route] = endpointTypeWebSocket
+		}
+	}
+
+	if config.WithConfigInfo {
+		if err := p.registerConfigInfo(meter); err != nil {
+			return nil, fmt.Errorf("failed to create %s gauge: %w", MetricConfigInfo, err)
+		}
+	}
+
+	if config.WithRuntimeMetrics {
+		if err := otelruntime.Start(otelruntime.WithMeterProvider(p.provider)); err != nil {
+			return nil, fmt.Errorf("failed to start the runtime metrics: %w", err)
+		}
+	}
+
+	if config.WithBuildInfo {
+		if err := p.registerBuildInfo(meter); err != nil {
+			return nil, fmt.Errorf("failed to create %s gauge: %w", MetricHTTPServerBuildInfo, err)
+		}
+	}
+
+	if err := p.registerRouteConcurrency(meter); err != nil {
+		return nil, fmt.Errorf("failed to create %s gauge: %w", MetricHTTPServerRouteConcurrencyUtilization, err)
+	}
+
+	if err := p.registerWorkerPools(meter); err != nil {
+		return nil, err
+	}
+
+	if config.RecordAsync {
+		if config.RecordAsyncBufferSize <= 0 {
+			config.RecordAsyncBufferSize = defaultRecordAsyncBufferSize
+		}
+
+		p.droppedRecords, err = meter.Int64Counter(
+			MetricMetricsDropped,
+			metric.WithDescription("Number of metric recordings dropped because the async record buffer was full."),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s counter: %w", MetricMetricsDropped, err)
+		}
+
+		p.records = make(chan func(ctx context.Context), config.RecordAsyncBufferSize)
+		p.recordsDone = make(chan struct{})
+	}
+
+	if p.records != nil {
+		go p.recordWorker()
+	}
+	return p, nil
+}
+
+// Setup registers the middleware on e and serves the ExporterHandler on MetricsPath,
+// like the legacy echo-contrib Prometheus.Use. See ListenAddress to serve it on a separate port.
+func (p *Metrics) Setup(e *echo.Echo) {
+	e.Use(p.Middleware())
+
+	router := e
+	if p.ListenAddress != "" || p.MetricsRouter != nil {
+		router = p.MetricsRouter
+		if router == nil {
+			router = echo.New()
+			router.HideBanner = true
+			router.HidePort = true
+		}
+	}
+
+	router.GET(p.MetricsPath, p.ExporterHandler())
+	if p.EnableResetEndpoint {
+		router.POST(p.MetricsPath+"/reset", p.ResetHandler())
+	}
+
+	if p.ListenAddress != "" {
+		go func() {
+			if err := router.Start(p.ListenAddress); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				router.Logger.Errorf("metrics server on %s stopped: %v", p.ListenAddress, err)
+			}
+		}()
+		e.Server.RegisterOnShutdown(func() {
+			_ = router.Shutdown(context.Background())
+		})
+	}
+}
+
+// Reset restarts all the metrics from zero by rebuilding the MeterProvider with the current config,
+// see Reload, e.g. so each test case starts from zero. The exporter is replaced in place on the same Registry.
+// It invalidates the meters returned by Meter before: the instruments created from them belong to the
+// previous MeterProvider which is shut down, create them again from a new Meter.
+// With a custom MiddlewareConfig.Reader it returns ErrReaderInUse, Reload with a new Reader instead.
+func (p *Metrics) Reset() error {
+	return p.Reload(p.Config())
+}
+
+// ResetHandler restarts all the metrics from zero, see Reset. It responds with 204 No Content.
+func (p *Metrics) ResetHandler() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := p.active().authorize(c); err != nil {
+			return err
+		}
+		if err := p.Reset(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to reset the metrics").SetInternal(err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
 }
 
 func (p *Metrics) Middleware() echo.MiddlewareFunc {
 	return p.handlerFunc
 }
 
+// Config returns a copy of the effective config, with the defaults applied by New.
+func (p *Metrics) Config() MiddlewareConfig {
+	return *p.active().MiddlewareConfig
+}
+
+// Meter returns a meter from the MeterProvider set up by the middleware, so custom instruments
+// end up in the same exporter (e.g. the same /metrics output) as the middleware's own ones.
+//
+// Prefer it over otel.Meter: a meter obtained from the global provider before New is called
+// may stay bound to whichever provider was installed first, depending on the init order.
+func (p *Metrics) Meter() metric.Meter {
+	return p.active().meter()
+}
+
+// meter returns the meter of the configured instrumentation scope
+func (p *Metrics) meter() metric.Meter {
+	return p.provider.Meter(p.ScopeName, metric.WithInstrumentationVersion(p.ScopeVersion))
+}
+
+// SetReady marks the app as ready or not ready. Requests handled while the app is not ready,
+// e.g. before the readiness probe passes or while draining, are counted in `http.server.requests_not_ready`
+// on top of the regular metrics. The app is ready by default.
+func (p *Metrics) SetReady(ready bool) {
+	p.active().notReady.Store(!ready)
+}
+
+// PreMiddleware returns a variant of the middleware intended for e.Pre, which also records the requests
+// rejected by pre-router middleware (with http.route="<pre-rejected>") that never reach the router.
+// Middleware must be registered with e.Use as well: when both are installed, the request is recorded
+// only once by PreMiddleware, and Middleware just tells it that the request was routed.
+// Note that the Skipper sees an empty c.Path() in the pre-router phase.
+func (p *Metrics) PreMiddleware() echo.MiddlewareFunc {
+	return p.preHandlerFunc
+}
+
 // HandlerFunc defines handler function for middleware
 func (p *Metrics) handlerFunc(next echo.HandlerFunc) echo.HandlerFunc {
+	return p.instrument(next, false)
+}
+
+// preHandlerFunc defines handler function for the pre-router middleware
+func (p *Metrics) preHandlerFunc(next echo.HandlerFunc) echo.HandlerFunc {
+	return p.instrument(next, true)
+}
+
+func (p *Metrics) instrument(next echo.HandlerFunc, pre bool) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		if p.Skipper(c) {
+		p := p.active()
+
+		if routed, ok := c.Get(preRoutedContextKey).(*bool); ok && !pre {
+			// the request is recorded by PreMiddleware, just flag that it got routed
+			*routed = true
 			return next(c)
 		}
 
+		if p.Skipper(c) || p.pathIgnored(c) || p.routeOptedOut(c) {
+			return next(c)
+		}
+
+		routeBehavior, routeLabel := p.specialRouteLabel(c.Request())
+		if routeBehavior == RouteLabelSkip {
+			return next(c)
+		}
+
+		var routed *bool
+		if pre {
+			routed = new(bool)
+			c.Set(preRoutedContextKey, routed)
+		}
+
 		start := time.Now()
-		reqSz := computeApproximateRequestSize(c.Request())
+		notReady := p.notReady.Load()
+		// math/rand/v2 draws from a per thread source, there is no lock to contend on
+		recordHistograms := p.SampleRate == 0 || p.SampleRate == 1 || rand.Float64() < p.SampleRate
+		var reqSz int
+		var chunkedBody *countingReadCloser
+		if !p.DisableSizeMetrics && recordHistograms {
+			if p.RequestSizeFunc != nil {
+				reqSz = p.RequestSizeFunc(c.Request())
+			} else {
+				reqSz = computeApproximateRequestSize(c.Request())
+				if r := c.Request(); r.ContentLength == -1 && r.Body != nil && r.Body != http.NoBody {
+					chunkedBody = &countingReadCloser{ReadCloser: r.Body}
+					r.Body = chunkedBody
+					defer func() {
+						r.Body = chunkedBody.ReadCloser
+					}()
+				}
+			}
+		}
 		host, port := p.RequestCounterHostLabelMappingFunc(c)
 
-		p.activeRequests.Add(c.Request().Context(), 1,
-			metric.WithAttributes(HttpRequestMethod.String(c.Request().Method), ServerAddress.String(host), URLScheme.String(c.Scheme())))
+		activeRequestsOpt := noAttributes
+		if !p.ActiveRequestsNoAttributes {
+			activeAttributes := []attribute.KeyValue{
+				HttpRequestMethod.String(p.requestMethod(c.Request())), ServerAddress.String(host), URLScheme.String(p.requestScheme(c)),
+			}
+			if p.WithActiveRequestRoute {
+				// the router already ran, c.Path() is populated unless this is PreMiddleware
+				var route string
+				if p.RouteTemplateResolver != nil {
+					route = p.RouteTemplateResolver(c)
+				} else {
+					route = p.RequestCounterURLLabelMappingFunc(c)
+				}
+				if routeBehavior == RouteLabelCollapse {
+					route = routeLabel
+				}
+				activeAttributes = append(activeAttributes, HttpRoute.String(route))
+			}
+			activeRequestsOpt = metric.WithAttributes(p.scrubAttributes(p.filterAttributes(activeAttributes))...)
+		}
+		p.activeRequests.Add(c.Request().Context(), 1, activeRequestsOpt)
+		// deferred on its own, so the gauge stays balanced even if the recording below panics
+		defer p.activeRequests.Add(c.Request().Context(), -1, activeRequestsOpt)
+		if p.WithConcurrencyHistogram {
+			p.concurrency.Record(c.Request().Context(), p.inFlight.Add(1), noAttributes)
+			defer p.inFlight.Add(-1)
+		}
 
-		err := next(c)
+		var counting *countingResponseWriter
+		// it also tells the WebSocketMode whether the connection was hijacked
+		if !p.DisableSizeMetrics || p.WriteTimeout > 0 || p.WithTTFB || p.WebSocketMode != WebSocketRecordDuration {
+			counting = &countingResponseWriter{ResponseWriter: c.Response().Writer, trackFirstByte: p.WithTTFB}
+			c.Response().Writer = counting
+			defer func() {
+				c.Response().Writer = counting.ResponseWriter
+			}()
+		}
 
-		status := c.Response().Status
+		// the recording is deferred so it also runs while a panic unwinds the stack,
+		// e.g. when middleware.Recover() is placed before this middleware
+		var err error
+		panicking := true
+		defer func() {
+			status := c.Response().Status
 
-		if err != nil {
-			var httpError *echo.HTTPError
-			if errors.As(err, &httpError) {
-				status = httpError.Code
-			}
-			if status == 0 || status == http.StatusOK {
+			var errorType string
+			if panicking {
 				status = http.StatusInternalServerError
+				errorType = "panic"
+			} else if err != nil {
+				var httpError *echo.HTTPError
+				if errors.As(err, &httpError) {
+					status = httpError.Code
+				} else {
+					errorType = fmt.Sprintf("%T", err)
+				}
+				if status == 0 || status == http.StatusOK {
+					status = http.StatusInternalServerError
+				}
+				// 4xx are not server errors per the semconv, only 5xx get the status code as error.type
+				if errorType == "" && status >= http.StatusInternalServerError {
+					errorType = strconv.Itoa(status)
+				}
 			}
-		}
 
-		elapsed := time.Since(start) / time.Millisecond
-		url := p.RequestCounterURLLabelMappingFunc(c)
+			elapsed := time.Since(start) / time.Millisecond
+			var url string
+			if p.URLLabelFromContext != "" {
+				url = urlLabelFromContext(c.Get(p.URLLabelFromContext))
+			} else if p.RouteTemplateResolver != nil {
+				url = p.RouteTemplateResolver(c)
+			} else {
+				url = p.RequestCounterURLLabelMappingFunc(c)
+				if url == "" && p.customURLLabelMapping {
+					return
+				}
+			}
+			if url == "" && status == http.StatusNotFound && p.notFoundPathSegments != nil {
+				url = p.notFoundPathSegmentLabel(c.Request().URL.Path)
+			}
+			if url == "" {
+				if p.RouteNormalizer != nil {
+					url = p.RouteNormalizer(c.Request().URL.Path)
+				} else {
+					url = p.UnmatchedRouteLabel
+				}
+			}
+			if routeBehavior == RouteLabelCollapse {
+				url = routeLabel
+			}
+			if pre && !*routed {
+				url = preRejectedRouteLabel
+			}
+			url = p.limitRouteCardinality(url)
+
+			elapsedSeconds := float64(elapsed) / float64(1000)
+			// the millisecond truncation above turns fast handlers into zero-valued samples
+			if floor := p.MinRecordedDuration.Seconds(); elapsedSeconds < floor {
+				elapsedSeconds = floor
+			}
+			reqDurValue := elapsedSeconds
+			if p.DurationUnit == unitMilliseconds {
+				reqDurValue = elapsedSeconds * 1000
+			}
 
-		elapsedSeconds := float64(elapsed) / float64(1000)
+			commonAttributes := []attribute.KeyValue{
+				URLScheme.String(p.requestScheme(c)),
+				HttpResponseStatusCode.Int(status),
+				HttpRequestMethod.String(p.requestMethod(c.Request())),
+				HttpRoute.String(url),
+			}
 
-		commonAttributes := []attribute.KeyValue{
-			URLScheme.String(c.Scheme()),
-			HttpResponseStatusCode.Int(status),
-			HttpRequestMethod.String(c.Request().Method),
-			HttpRoute.String(url),
-		}
+			if p.WithStatusClass {
+				commonAttributes = append(commonAttributes, HttpResponseStatusClass.String(statusClass(status)))
+			}
+
+			if p.WithProtocolVersion {
+				commonAttributes = append(commonAttributes,
+					NetworkProtocolName.String("http"),
+					NetworkProtocolVersion.String(protocolVersion(c.Request())))
+			}
 
-		if p.EnableServerAddrPort {
-			if host != "" {
+			if p.PromoteInstanceLabel {
+				commonAttributes = append(commonAttributes, ServiceInstanceID.String(p.instanceID))
+			}
+
+			if p.EnableServerAddrPort && host != "" {
 				commonAttributes = append(commonAttributes, ServerAddress.String(host))
 			}
-			if port != 0 {
-				commonAttributes = append(commonAttributes, ServerPort.Int(port))
+			if p.EnableServerAddrPort || p.WithServerPort {
+				if port == 0 {
+					port = defaultPort(p.requestScheme(c))
+				}
+				if port != 0 {
+					commonAttributes = append(commonAttributes, ServerPort.Int(port))
+				}
 			}
-		}
 
-		p.reqDuration.Record(c.Request().Context(), elapsedSeconds, metric.WithAttributes(commonAttributes...))
+			if p.HandlerNameFromContext != "" {
+				if name, ok := c.Get(p.HandlerNameFromContext).(string); ok && name != "" {
+					commonAttributes = append(commonAttributes, Handler.String(name))
+				}
+			}
 
-		p.requests.Add(c.Request().Context(), 1,
-			metric.WithAttributes(commonAttributes...))
+			if p.AdditionalAttributes != nil {
+				commonAttributes = append(commonAttributes, p.AdditionalAttributes(c)...)
+			}
 
-		p.reqSize.Record(c.Request().Context(), int64(reqSz),
-			metric.WithAttributes(commonAttributes...))
+			commonAttributes = p.filterAttributes(commonAttributes)
+			p.scrubAttributes(commonAttributes)
 
-		resSz := float64(c.Response().Size)
-		p.resSize.Record(c.Request().Context(), int64(resSz),
-			metric.WithAttributes(commonAttributes...))
+			// durationAttributes carry error.type on failed requests, it is left out of the size histograms
+			// to bound their cardinality
+			durationAttributes := commonAttributes
+			if errorType != "" && !p.attributeDisabled(ErrorType) {
+				durationAttributes = append(slices.Clip(commonAttributes), p.scrubAttributes([]attribute.KeyValue{ErrorType.String(errorType)})...)
+			}
 
-		p.activeRequests.Add(c.Request().Context(), -1,
-			metric.WithAttributes(HttpRequestMethod.String(c.Request().Method), ServerAddress.String(host), URLScheme.String(c.Scheme())))
+			// requestsAttributes are only attached to the requests counter
+			requestsAttributes := slices.Clip(durationAttributes)
+			if p.WithTrailersAttribute {
+				requestsAttributes = append(requestsAttributes, HasTrailers.Bool(hasTrailers(c.Response().Header())))
+			}
+			if p.WithSerializerAttribute {
+				requestsAttributes = append(requestsAttributes, ResponseSerializer.String(responseSerializer(c.Response().Header().Get(echo.HeaderContentType))))
+			}
+			if p.WithClientCertAttribute {
+				tls := c.Request().TLS
+				requestsAttributes = append(requestsAttributes, ClientCertPresent.Bool(tls != nil && len(tls.PeerCertificates) > 0))
+			}
+			if p.WithBotAttribute {
+				requestsAttributes = append(requestsAttributes, ClientIsBot.Bool(p.isBot(c.Request().UserAgent())))
+			}
+			if p.CacheResultHeader != "" {
+				requestsAttributes = append(requestsAttributes, CacheResult.String(cacheResult(c.Response().Header().Get(p.CacheResultHeader))))
+			}
+			if p.endpointTypes != nil {
+				endpointType, ok := p.endpointTypes[c.Path()]
+				if !ok {
+					endpointType = endpointTypeREST
+				}
+				requestsAttributes = append(requestsAttributes, EndpointType.String(endpointType))
+			}
+			if p.LogicalErrorContextKey != "" {
+				outcome := "success"
+				if status >= http.StatusInternalServerError || isLogicalError(c.Get(p.LogicalErrorContextKey)) {
+					outcome = "error"
+				}
+				requestsAttributes = append(requestsAttributes, Outcome.String(outcome))
+			}
+
+			requestsAttributes = p.filterAttributes(requestsAttributes)
+			p.scrubAttributes(requestsAttributes[len(durationAttributes):])
+
+			// trace_sampled is only attached to the duration histograms
+			if p.WithTraceSampledAttribute && !p.attributeDisabled(TraceSampled) {
+				sampled := trace.SpanContextFromContext(c.Request().Context()).IsSampled()
+				durationAttributes = append(slices.Clip(durationAttributes), TraceSampled.Bool(sampled))
+			}
+
+			// the attribute sets are built once and shared by the Record/Add calls below,
+			// metric.WithAttributes would copy and sort the attributes on every call
+			commonOpt := attributeSetOption(commonAttributes)
+			// both only differ from commonAttributes by appended attributes
+			durationOpt, requestsOpt := commonOpt, commonOpt
+			if len(durationAttributes) != len(commonAttributes) {
+				durationOpt = attributeSetOption(durationAttributes)
+			}
+			if len(requestsAttributes) != len(commonAttributes) {
+				requestsOpt = attributeSetOption(requestsAttributes)
+			}
+
+			// routeAttributes are attached to the counters of requests which did not complete normally
+			routeAttributes := p.scrubAttributes(p.filterAttributes([]attribute.KeyValue{HttpRoute.String(url)}))
+
+			resSz := c.Response().Size
+			var hijacked, writeTimedOut bool
+			var ttfbSeconds float64
+			if counting != nil {
+				hijacked = counting.hijacked
+				writeTimedOut = p.writeTimedOut(counting.writeErr, time.Since(start))
+				if !counting.firstByte.IsZero() && !hijacked {
+					ttfbSeconds = counting.firstByte.Sub(start).Seconds()
+				}
+				// the handler bypassed echo.Response and wrote to the underlying writer directly
+				if resSz == 0 {
+					resSz = counting.written
+				}
+			}
+
+			// gorilla/websocket and friends hijack the connection and write the 101 response on their own
+			webSocket := p.WebSocketMode != WebSocketRecordDuration &&
+				(status == http.StatusSwitchingProtocols || hijacked) &&
+				strings.EqualFold(c.Request().Header.Get(echo.HeaderUpgrade), "websocket")
+
+			countError := p.WithErrorCounter && (status >= http.StatusInternalServerError ||
+				p.ErrorCounterIncludeClientErrors && status >= http.StatusBadRequest)
+			var errorAttributes []attribute.KeyValue
+			if countError {
+				errorAttributes = p.scrubAttributes(p.filterAttributes([]attribute.KeyValue{
+					HttpRequestMethod.String(p.requestMethod(c.Request())), HttpRoute.String(url),
+				}))
+			}
+
+			uncompressed := p.UncompressedCompressibleThreshold > 0 && !hijacked &&
+				resSz > p.UncompressedCompressibleThreshold && uncompressedCompressible(c.Response().Header())
+
+			var setCookies int
+			if p.WithSetCookieCount {
+				setCookies = len(c.Response().Header().Values(echo.HeaderSetCookie))
+			}
+
+			var urlLen, headerSz int
+			if p.WithRequestURLAndHeaderSize {
+				urlLen = len(c.Request().URL.String())
+				headerSz = computeApproximateHeaderSize(c.Request())
+			}
+
+			var bindSeconds float64
+			var bindRecorded bool
+			if p.BindDurationContextKey != "" {
+				bindSeconds, bindRecorded = durationSeconds(c.Get(p.BindDurationContextKey))
+			}
+
+			// a copy, record would move reqSz to the heap if it captured a variable assigned after the capture
+			reqBytes := reqSz
+			if chunkedBody != nil {
+				reqBytes += int(chunkedBody.read)
+			}
+
+			// record must not touch the echo.Context, it may run after the context has been released
+			record := func(ctx context.Context) {
+				if webSocket {
+					if p.WebSocketMode == WebSocketCountConnections {
+						p.webSocketConnections.Add(ctx, 1, metric.WithAttributes(routeAttributes...))
+					}
+				} else if recordHistograms {
+					p.reqDuration.Record(ctx, reqDurValue, durationOpt)
+				}
+
+				if ttfbSeconds > 0 {
+					p.timeToFirstByte.Record(ctx, ttfbSeconds, durationOpt)
+				}
+
+				if p.WithLongDurationHistogram && !webSocket && elapsedSeconds > p.LongDurationThreshold.Seconds() {
+					p.longReqDuration.Record(ctx, elapsedSeconds, durationOpt)
+				}
+
+				if p.TrimmedDurationThreshold > 0 && !webSocket {
+					trimmedSeconds := elapsedSeconds
+					if threshold := p.TrimmedDurationThreshold.Seconds(); trimmedSeconds > threshold {
+						trimmedSeconds = threshold
+						p.clampedReqDuration.Add(ctx, 1, durationOpt)
+					}
+					p.trimmedReqDuration.Record(ctx, trimmedSeconds, durationOpt)
+				}
+
+				if sample, ok := p.counterSamples[url]; !ok {
+					p.requests.Add(ctx, 1, requestsOpt)
+				} else if sample.seen.Add(1)%sample.every == 0 {
+					p.requests.Add(ctx, sample.every, requestsOpt)
+				}
+
+				if notReady {
+					p.requestsNotReady.Add(ctx, 1, commonOpt)
+				}
+
+				// middleware.BodyLimit returns echo.ErrStatusRequestEntityTooLarge before the handler is reached
+				if status == http.StatusRequestEntityTooLarge {
+					p.bodyLimitRejected.Add(ctx, 1, metric.WithAttributes(routeAttributes...))
+				}
+
+				if writeTimedOut {
+					p.writeTimeouts.Add(ctx, 1, metric.WithAttributes(routeAttributes...))
+				}
+
+				if countError {
+					p.serverErrors.Add(ctx, 1, metric.WithAttributes(errorAttributes...))
+				}
+
+				if uncompressed {
+					p.uncompressedCompressible.Add(ctx, 1, metric.WithAttributes(routeAttributes...))
+				}
+
+				if !p.DisableSizeMetrics && recordHistograms {
+					p.reqSize.Record(ctx, int64(reqBytes), commonOpt)
+
+					// the size of a hijacked connection is unknown, rather than a misleading 0
+					if !hijacked {
+						p.resSize.Record(ctx, resSz, commonOpt)
+					}
+				}
+
+				if p.WithSetCookieCount {
+					p.setCookieCount.Record(ctx, int64(setCookies), commonOpt)
+				}
+
+				if p.WithRequestURLAndHeaderSize {
+					p.reqURLLength.Record(ctx, int64(urlLen), commonOpt)
+					p.reqHeaderSize.Record(ctx, int64(headerSz), commonOpt)
+				}
+
+				if bindRecorded {
+					p.bindDuration.Record(ctx, bindSeconds, commonOpt)
+				}
+			}
+
+			if p.RecordAsync {
+				p.recordAsync(c.Request().Context(), record)
+			} else {
+				record(c.Request().Context())
+			}
+		}()
+
+		err = next(c)
+		panicking = false
 		return err
 	}
 }
 
-func (p *Metrics) initMetricsMeterProvider() *prometheus.Exporter {
+// attributeSetOption returns the option of the attribute set of kvs, kvs is copied as attribute.NewSet
+// sorts in place and the attribute slices of a request share their backing arrays
+func attributeSetOption(kvs []attribute.KeyValue) metric.MeasurementOption {
+	return metric.WithAttributeSet(attribute.NewSet(slices.Clone(kvs)...))
+}
+
+// SkipRouteMetrics opts a route out of the metrics by prefixing its name with "nometrics:",
+// e.g. `SkipRouteMetrics(e.GET("/healthz", handler))`. Naming a route "nometrics:..." directly works as well.
+// The route is only known after routing, so it has no effect on requests recorded by PreMiddleware.
+func SkipRouteMetrics(route *echo.Route) *echo.Route {
+	if !strings.HasPrefix(route.Name, noMetricsRouteNamePrefix) {
+		route.Name = noMetricsRouteNamePrefix + route.Name
+	}
+	return route
+}
+
+// pathIgnored reports whether the request matches any of the IgnorePaths patterns, or is a scrape
+// of MetricsPath without IncludeMetricsEndpoint
+func (p *Metrics) pathIgnored(c echo.Context) bool {
+	if len(p.IgnorePaths) == 0 && p.IncludeMetricsEndpoint {
+		return false
+	}
+	routePath := c.Path()
+	if routePath == "" {
+		routePath = c.Request().URL.Path
+	}
+	if routePath == p.MetricsPath && !p.IncludeMetricsEndpoint {
+		return true
+	}
+	for _, pattern := range p.IgnorePaths {
+		// the patterns are validated by New
+		if ok, _ := path.Match(pattern, routePath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// requestMethod returns the http.request.method of r, see MiddlewareConfig.NormalizeMethods
+func (p *Metrics) requestMethod(r *http.Request) string {
+	if p.NormalizeMethods == nil || *p.NormalizeMethods {
+		return normalizeMethod(r.Method)
+	}
+	return r.Method
+}
+
+// routeOptedOut reports whether the matched route is marked with SkipRouteMetrics
+func (p *Metrics) routeOptedOut(c echo.Context) bool {
+	routePath := c.Path()
+	if routePath == "" {
+		return false
+	}
+	// a route of a non-standard method opts all of them out on its path
+	method := normalizeMethod(c.Request().Method)
+	key := method + " " + routePath
+	if optedOut, ok := p.optedOutRoutes.Load(key); ok {
+		return optedOut.(bool)
+	}
+
+	optedOut := false
+	for _, route := range c.Echo().Routes() {
+		if route.Path == routePath && (normalizeMethod(route.Method) == method || route.Method == echo.RouteNotFound) &&
+			strings.HasPrefix(route.Name, noMetricsRouteNamePrefix) {
+			optedOut = true
+			break
+		}
+	}
+	p.optedOutRoutes.Store(key, optedOut)
+	return optedOut
+}
+
+// specialRouteLabel returns the configured behavior and the dedicated route label
+// for CORS preflight and CONNECT requests
+func (p *Metrics) specialRouteLabel(r *http.Request) (RouteLabelBehavior, string) {
+	switch {
+	case r.Method == http.MethodOptions && r.Header.Get(echo.HeaderAccessControlRequestMethod) != "":
+		return p.PreflightRouteLabel, preflightRouteLabel
+	case r.Method == http.MethodConnect:
+		return p.ConnectRouteLabel, connectRouteLabel
+	default:
+		return RouteLabelAsIs, ""
+	}
+}
+
+// defaultURLLabelMapping is the default MiddlewareConfig.RequestCounterURLLabelMappingFunc
+func defaultURLLabelMapping(c echo.Context) string {
+	// contains route path ala `/users/:id`
+	// as of Echo v4.10.1 path is empty for 404 cases (when router did not find any matching routes)
+	return c.Path()
+}
+
+// urlLabelFromContext returns the http.route set in the context for MiddlewareConfig.URLLabelFromContext
+func urlLabelFromContext(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "unknown"
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// limitRouteCardinality returns route, or "__overflow__" once MaxRouteCardinality distinct routes were recorded
+func (p *Metrics) limitRouteCardinality(route string) string {
+	if p.MaxRouteCardinality <= 0 {
+		return route
+	}
+	if _, ok := p.seenRoutes.Load(route); ok {
+		return route
+	}
+
+	p.seenRoutesMu.Lock()
+	defer p.seenRoutesMu.Unlock()
+	if _, ok := p.seenRoutes.Load(route); ok {
+		return route
+	}
+	if p.seenRouteCount >= p.MaxRouteCardinality {
+		return overflowRouteLabel
+	}
+	p.seenRoutes.Store(route, struct{}{})
+	p.seenRouteCount++
+	return route
+}
+
+// notFoundPathSegmentLabel returns the first path segment if it is allowlisted, or "<other>"
+func (p *Metrics) notFoundPathSegmentLabel(path string) string {
+	segment, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if _, ok := p.notFoundPathSegments[segment]; ok {
+		return segment
+	}
+	return otherRouteLabel
+}
+
+// NormalizeRoutePath is a RouteNormalizer which strips the query and replaces
+// every all-digit path segment by ":num", e.g. "/orders/42?x=1" becomes "/orders/:num".
+func NormalizeRoutePath(path string) string {
+	path, _, _ = strings.Cut(path, "?")
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if segment != "" && strings.Trim(segment, "0123456789") == "" {
+			segments[i] = ":num"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// attributeDisabled reports whether the attribute key is in MiddlewareConfig.DisabledAttributes
+func (p *Metrics) attributeDisabled(key attribute.Key) bool {
+	_, ok := p.disabledAttributes[key]
+	return ok
+}
+
+// filterAttributes removes the disabled attributes in place
+func (p *Metrics) filterAttributes(attrs []attribute.KeyValue) []attribute.KeyValue {
+	if p.disabledAttributes == nil {
+		return attrs
+	}
+	return slices.DeleteFunc(attrs, func(attr attribute.KeyValue) bool {
+		return p.attributeDisabled(attr.Key)
+	})
+}
+
+// scrubAttributes applies the AttributeScrubber to the string attributes in place
+func (p *Metrics) scrubAttributes(attrs []attribute.KeyValue) []attribute.KeyValue {
+	if p.AttributeScrubber == nil {
+		return attrs
+	}
+	for i, attr := range attrs {
+		if attr.Value.Type() == attribute.STRING {
+			attrs[i] = attr.Key.String(p.AttributeScrubber(attr.Key, attr.Value.AsString()))
+		}
+	}
+	return attrs
+}
+
+// recordAsync hands the record func over to the background worker, or drops it when the buffer is full
+func (p *Metrics) recordAsync(ctx context.Context, record func(ctx context.Context)) {
+	p.recordsMu.RLock()
+	defer p.recordsMu.RUnlock()
+	// a request still in flight when Reload replaced the instance, its provider is being shut down
+	if p.recordsClosed {
+		return
+	}
+	select {
+	case p.records <- record:
+	default:
+		p.droppedRecords.Add(ctx, 1)
+	}
+}
+
+// recordWorker runs the buffered record funcs until stopRecordWorker closes the buffer
+func (p *Metrics) recordWorker() {
+	defer close(p.recordsDone)
+	for record := range p.records {
+		record(context.Background())
+	}
+}
+
+// stopRecordWorker closes the buffer of RecordAsync and waits for the recordWorker to run the
+// remaining records, the later ones are dropped. It is called by Reload on the replaced instance.
+func (p *Metrics) stopRecordWorker() {
+	if p.records == nil {
+		return
+	}
+	p.recordsMu.Lock()
+	if !p.recordsClosed {
+		p.recordsClosed = true
+		close(p.records)
+	}
+	p.recordsMu.Unlock()
+	<-p.recordsDone
+}
+
+// sanitizeNamespace makes ns a valid Prometheus metric name prefix, invalid chars are replaced with
+// `_` and a leading digit gets a `_` prefix, e.g. "9app.api" becomes "_9app_api"
+func sanitizeNamespace(ns string) string {
+	if ns == "" {
+		return ns
+	}
+	sanitized := strings.Map(func(r rune) rune {
+		if r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, ns)
+	if sanitized[0] >= '0' && sanitized[0] <= '9' {
+		sanitized = "_" + sanitized
+	}
+	return sanitized
+}
+
+func (p *Metrics) initMetricsMeterProvider() (sdkmetric.Reader, error) {
 	namespace := p.Namespace
 	if namespace == "" {
 		namespace = p.ServiceName
 	}
 	namespace = strings.ReplaceAll(namespace, "-", "_")
 
+	metricNamespace := namespace
+	if p.MetricPrefix != "" {
+		prefix := strings.ReplaceAll(p.MetricPrefix, "-", "_")
+		if metricNamespace == "" {
+			metricNamespace = prefix
+		} else {
+			metricNamespace = prefix + "_" + metricNamespace
+		}
+	}
+	if sanitized := sanitizeNamespace(metricNamespace); sanitized != metricNamespace {
+		otel.Handle(fmt.Errorf("metrics namespace %q is not a valid Prometheus name prefix, using %q", metricNamespace, sanitized))
+		metricNamespace = sanitized
+	}
+
+	if p.isPrometheusPull() && p.collector == nil {
+		collector, err := registerCollector(p.Registerer)
+		if err != nil {
+			return nil, err
+		}
+		p.collector = collector
+	}
+
 	opts := []prometheus.Option{
-		prometheus.WithRegisterer(p.Registerer),
+		// the exporter collector is unchecked and can not be unregistered, it is swapped by Reload instead
+		prometheus.WithRegisterer(p.collector),
 	}
 
-	res, err := resource.Merge(resource.Default(),
-		resource.NewSchemaless(
+	res := p.Resource
+	if res == nil {
+		attrs := append([]attribute.KeyValue{
 			semconv.ServiceName(p.ServiceName),
 			semconv.ServiceVersion(p.ServiceVersion),
 			semconv.ServiceNamespace(namespace),
-		))
-	if err != nil {
-		panic(err)
+		}, p.ResourceAttributes...)
+		var err error
+		res, err = resource.Merge(resource.Default(), resource.NewSchemaless(attrs...))
+		if err != nil {
+			return nil, fmt.Errorf("failed to merge resource: %w", err)
+		}
+	}
+
+	if p.PromoteInstanceLabel {
+		// the MeterProvider merges the environment into the resource the same way
+		withEnv, _ := resource.Merge(resource.Environment(), res)
+		if v, ok := withEnv.Set().Value(semconv.ServiceInstanceIDKey); ok {
+			p.instanceID = v.AsString()
+		} else if hostname, err := os.Hostname(); err == nil {
+			p.instanceID = hostname
+		}
 	}
 
-	if namespace != "" {
-		opts = append(opts, prometheus.WithNamespace(namespace))
+	if metricNamespace != "" {
+		opts = append(opts, prometheus.WithNamespace(metricNamespace))
 	}
 	if !p.WithScopeInfo {
 		opts = append(opts, prometheus.WithoutScopeInfo())
 	}
-	exporter, err := prometheus.New(opts...)
+	if p.WithoutUnits {
+		opts = append(opts, prometheus.WithoutUnits())
+	}
+	if p.WithoutCounterSuffixes {
+		opts = append(opts, prometheus.WithoutCounterSuffixes())
+	}
+	if p.WithoutTargetInfo {
+		opts = append(opts, prometheus.WithoutTargetInfo())
+	}
+	reader, err := p.newReader(opts)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to create %s exporter: %w", p.ExporterKind, err)
+	}
+
+	// disable exemplar https://github.com/open-telemetry/opentelemetry-go/releases/tag/v1.32.0
+	// which cause problem with prometheus exporter for gauge type
+	exemplarFilter := exemplar.AlwaysOffFilter
+	if p.WithExemplars {
+		// only measurements made with a sampled span in the context get an exemplar, which the gauges never have
+		exemplarFilter = exemplar.TraceBasedFilter
 	}
 
 	provider := sdkmetric.NewMeterProvider(
 		sdkmetric.WithResource(res),
 		// view see https://github.com/open-telemetry/opentelemetry-go/blob/v1.11.2/exporters/prometheus/exporter_test.go#L291
-		sdkmetric.WithReader(exporter),
-		// disable exemplar https://github.com/open-telemetry/opentelemetry-go/releases/tag/v1.32.0
-		// which cause problem with prometheus exporter for gauge type
-		sdkmetric.WithExemplarFilter(exemplar.AlwaysOffFilter),
+		sdkmetric.WithView(p.Views...),
+		sdkmetric.WithReader(reader),
+		sdkmetric.WithExemplarFilter(exemplarFilter),
 	)
 
-	otel.SetMeterProvider(provider)
+	if p.SetGlobalProvider == nil || *p.SetGlobalProvider {
+		otel.SetMeterProvider(provider)
+	}
+	p.provider = provider
 
-	return exporter
+	return reader, nil
 }
 
 func (p *Metrics) ExporterHandler() echo.HandlerFunc {
-	opts := promhttp.HandlerOpts{}
+	p = p.active()
+	if !p.isPrometheusPull() {
+		// metrics are pushed, there is nothing to scrape
+		return func(c echo.Context) error {
+			return echo.ErrNotFound
+		}
+	}
+
+	opts := promhttp.HandlerOpts{
+		// exemplars are only encoded in the OpenMetrics format
+		EnableOpenMetrics:  p.EnableOpenMetrics || p.WithExemplars,
+		DisableCompression: p.DisableCompression,
+		ErrorHandling:      p.HandlerErrorHandling,
+		ErrorLog:           p.ErrorLog,
+	}
 	if p.Registry != nil {
 		opts.Registry = p.Registry
 	}
-	h := promhttp.HandlerFor(p.Gatherer, opts)
+	h := promhttp.HandlerFor(p.gatherer(), opts)
 
 	return func(c echo.Context) error {
-		h.ServeHTTP(c.Response(), c.Request())
-		return nil
+		if err := p.authorize(c); err != nil {
+			return err
+		}
+
+		// promhttp encodes the metric families straight into the response writer, without buffering the payload,
+		// with MaxScrapeBytes it is held back so an oversized scrape can still be turned into an error
+		var w http.ResponseWriter = c.Response()
+		var limited *limitedResponseWriter
+		if p.MaxScrapeBytes > 0 {
+			limited = &limitedResponseWriter{ResponseWriter: w, remaining: p.MaxScrapeBytes}
+			w = limited
+		}
+
+		var err error
+		if p.MetricsErrorAsJSON {
+			err = serveJSONErrors(c, w, h)
+		} else {
+			h.ServeHTTP(w, c.Request())
+		}
+
+		if limited == nil || err != nil {
+			return err
+		}
+		if !limited.exceeded {
+			return limited.flush()
+		}
+
+		c.Logger().Errorf("metrics scrape failed: %v", errScrapeTooLarge)
+		header := c.Response().Header()
+		header.Del(echo.HeaderContentEncoding)
+		header.Del(echo.HeaderContentType)
+		header.Del(echo.HeaderXContentTypeOptions)
+		if p.MetricsErrorAsJSON {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": errScrapeTooLarge.Error()})
+		}
+		return c.String(http.StatusInternalServerError, errScrapeTooLarge.Error())
 	}
 }
 
-func computeApproximateRequestSize(r *http.Request) int {
-	s := 0
-	if r.URL != nil {
-		s = len(r.URL.Path)
+// protocolVersion maps the request proto to the semconv network.protocol.version, e.g. "1.1" or "2"
+func protocolVersion(r *http.Request) string {
+	if r.ProtoMajor >= 2 && r.ProtoMinor == 0 {
+		return strconv.Itoa(r.ProtoMajor)
 	}
+	return strconv.Itoa(r.ProtoMajor) + "." + strconv.Itoa(r.ProtoMinor)
+}
 
-	s += len(r.Method)
-	s += len(r.Proto)
+// requestScheme returns the url.scheme of the request, see MiddlewareConfig.TrustForwardedHeaders
+func (p *Metrics) requestScheme(c echo.Context) string {
+	scheme := c.Scheme()
+	if p.TrustForwardedHeaders || scheme == "http" || scheme == "https" {
+		return scheme
+	}
+	if c.Request().TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// defaultPort returns the well-known port of the url scheme, or 0 if unknown
+func defaultPort(scheme string) int {
+	switch scheme {
+	case "http":
+		return 80
+	case "https":
+		return 443
+	default:
+		return 0
+	}
+}
+
+// isLogicalError reports whether a handler flagged the request as logically failed
+func isLogicalError(v interface{}) bool {
+	switch flag := v.(type) {
+	case bool:
+		return flag
+	case error:
+		return flag != nil
+	default:
+		return false
+	}
+}
+
+// durationSeconds converts a duration reported by a handler, a time.Duration or float64 seconds
+func durationSeconds(v interface{}) (float64, bool) {
+	switch d := v.(type) {
+	case time.Duration:
+		return d.Seconds(), true
+	case float64:
+		return d, true
+	default:
+		return 0, false
+	}
+}
+
+// hasTrailers reports whether the response header declares trailers, either via the "Trailer" header
+// or by keys prefixed with http.TrailerPrefix set after the header was written.
+func hasTrailers(h http.Header) bool {
+	if len(h.Values("Trailer")) > 0 {
+		return true
+	}
+	for name := range h {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// responseSerializer maps a response Content-Type to a bounded set of serializer names
+func responseSerializer(contentType string) string {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return "json"
+	case mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml"):
+		return "xml"
+	case mediaType == echo.MIMEApplicationProtobuf || mediaType == "application/x-protobuf" || strings.HasSuffix(mediaType, "+proto"):
+		return "protobuf"
+	default:
+		return "other"
+	}
+}
+
+// writeTimeoutTolerance is how close to the WriteTimeout hint a failed write counts as a write timeout
+const writeTimeoutTolerance = 0.9
+
+// writeTimedOut reports whether a response write failed at about the WriteTimeout hint
+func (p *Metrics) writeTimedOut(writeErr error, elapsed time.Duration) bool {
+	return p.WriteTimeout > 0 && writeErr != nil &&
+		elapsed >= time.Duration(float64(p.WriteTimeout)*writeTimeoutTolerance)
+}
+
+// isBot reports whether the User-Agent matches any of the bot patterns
+func (p *Metrics) isBot(userAgent string) bool {
+	userAgent = strings.ToLower(userAgent)
+	for _, pattern := range p.botUserAgentPatterns {
+		if strings.Contains(userAgent, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressibleContentTypes are the media types, besides text/*, which usually compress well
+var compressibleContentTypes = []string{"json", "xml", "javascript", "ecmascript", "svg", "yaml", "csv", "graphql", "wasm"}
+
+// uncompressedCompressible reports whether the response has a compressible content type
+// but no Content-Encoding other than identity
+func uncompressedCompressible(header http.Header) bool {
+	if encoding := header.Get(echo.HeaderContentEncoding); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return false
+	}
+	mediaType, _, _ := strings.Cut(strings.ToLower(header.Get(echo.HeaderContentType)), ";")
+	mediaType = strings.TrimSpace(mediaType)
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	for _, token := range compressibleContentTypes {
+		if strings.Contains(mediaType, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheResult maps a cache status header value, e.g. "HIT", "TCP_MISS" or "HIT from cloudfront",
+// to hit, miss or bypass. Missing or unknown values are reported as bypass.
+func cacheResult(value string) string {
+	value = strings.ToLower(value)
+	switch {
+	case strings.Contains(value, "hit"):
+		return "hit"
+	case strings.Contains(value, "miss") || strings.Contains(value, "expired"):
+		return "miss"
+	default:
+		return "bypass"
+	}
+}
+
+// computeApproximateHeaderSize sums up the length of all request header names and values
+func computeApproximateHeaderSize(r *http.Request) int {
+	s := 0
 	for name, values := range r.Header {
 		s += len(name)
 		for _, value := range values {
 			s += len(value)
 		}
 	}
+	return s
+}
+
+// computeApproximateRequestSize sums up the length of the URL path, method, proto, headers, host and
+// ContentLength. A chunked body has no ContentLength (-1), the bytes the handler read are added by the
+// middleware afterwards instead.
+func computeApproximateRequestSize(r *http.Request) int {
+	s := 0
+	if r.URL != nil {
+		s = len(r.URL.Path)
+	}
+
+	s += len(r.Method)
+	s += len(r.Proto)
+	s += computeApproximateHeaderSize(r)
 	s += len(r.Host)
 
 	// N.B. r.Form and r.MultipartForm are assumed to be included in r.URL.
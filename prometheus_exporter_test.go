@@ -1,17 +1,38 @@
 package echootelmetrics
 
 import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/trace"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestCompModeCustomRegistryMetricsDoNotRecord404Route(t *testing.T) {
@@ -42,7 +63,7 @@ func TestDefaultRegistryMetrics(t *testing.T) {
 	s, code := requestBody(e, "/metrics")
 	assert.Equal(t, http.StatusOK, code)
 	assert.Contains(t, s, `myapp_http_server_request_duration_seconds_count{http_request_method="GET",http_response_status_code="404",http_route="",url_scheme="http"} 1`)
-	unregisterDefaults("myapp")
+	prom.Unregister()
 }
 
 func TestPrometheus_Buckets(t *testing.T) {
@@ -136,79 +157,3103 @@ func TestMetricsForErrors(t *testing.T) {
 	assert.Contains(t, body, fmt.Sprintf("%s_requests_total", "myapp"))
 	assert.Contains(t, body, `myapp_requests_total{http_request_method="GET",http_response_status_code="200",http_route="/handler_for_ok",url_scheme="http"} 1`)
 	assert.Contains(t, body, `myapp_requests_total{http_request_method="GET",http_response_status_code="409",http_route="/handler_for_nok",url_scheme="http"} 2`)
-	assert.Contains(t, body, `myapp_requests_total{http_request_method="GET",http_response_status_code="502",http_route="/handler_for_error",url_scheme="http"} 1`)
+	assert.Contains(t, body, `myapp_requests_total{error_type="502",http_request_method="GET",http_response_status_code="502",http_route="/handler_for_error",url_scheme="http"} 1`)
+	assert.Contains(t, body, `myapp_http_server_request_duration_seconds_count{error_type="502",http_request_method="GET",http_response_status_code="502",http_route="/handler_for_error",url_scheme="http"} 1`)
+	assert.Contains(t, body, `myapp_http_server_response_body_size_bytes_count{http_request_method="GET",http_response_status_code="502",http_route="/handler_for_error",url_scheme="http"} 1`)
 }
 
-func requestBody(e *echo.Echo, path string) (string, int) {
-	req := httptest.NewRequest(http.MethodGet, path, nil)
+func TestActiveRequestsNoAttributes(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:                   customRegistry,
+		ActiveRequestsNoAttributes: true,
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	e.GET("/test", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+	e.POST("/test", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/test"))
+	req := httptest.NewRequest(http.MethodPost, "/test", nil)
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "\nhttp_server_active_requests 0\n") // the scrape itself is not recorded
+	assert.NotContains(t, body, "http_server_active_requests{")
+}
+
+func TestWithActiveRequestRoute(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:               customRegistry,
+		WithActiveRequestRoute: true,
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	var inFlight string
+	e.GET("/users/:id", func(c echo.Context) error {
+		inFlight, _ = requestBody(e, "/metrics")
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/users/1"))
+	assert.Contains(t, inFlight, `http_server_active_requests{http_request_method="GET",http_route="/users/:id",server_address="example.com",url_scheme="http"} 1`)
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	// the decrement uses the same route as the increment
+	assert.Contains(t, body, `http_server_active_requests{http_request_method="GET",http_route="/users/:id",server_address="example.com",url_scheme="http"} 0`)
+	assert.NotContains(t, body, `http_route="/metrics"`)
+}
+
+func TestWithTrailersAttribute(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:              customRegistry,
+		WithTrailersAttribute: true,
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	e.GET("/trailers", func(c echo.Context) error {
+		c.Response().Header().Set("Trailer", "X-Status")
+		c.Response().WriteHeader(http.StatusOK)
+		_, _ = c.Response().Write([]byte("OK"))
+		c.Response().Header().Set("X-Status", "done")
+		return nil
+	})
+	e.GET("/plain", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/trailers"))
+	assert.Equal(t, http.StatusOK, request(e, "/plain"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{has_trailers="true",http_request_method="GET",http_response_status_code="200",http_route="/trailers",url_scheme="http"} 1`)
+	assert.Contains(t, body, `requests_total{has_trailers="false",http_request_method="GET",http_response_status_code="200",http_route="/plain",url_scheme="http"} 1`)
+}
+
+func TestMetricPrefix(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:     customRegistry,
+		MetricPrefix: "teamx",
+		Namespace:    "myservice",
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	assert.Equal(t, http.StatusNotFound, request(e, "/ping"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `teamx_myservice_requests_total{http_request_method="GET",http_response_status_code="404",http_route="",url_scheme="http"} 1`)
+	assert.Contains(t, body, `service_namespace="myservice"`)
+}
+
+func TestWithRequestURLAndHeaderSize(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:                    customRegistry,
+		WithRequestURLAndHeaderSize: true,
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	e.GET("/test", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	for i := 0; i < 100; i++ {
+		req.Header.Set(fmt.Sprintf("X-Junk-%d", i), strings.Repeat("x", 512))
+	}
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `http_server_request_url_length_bytes_bucket{http_request_method="GET",http_response_status_code="200",http_route="/test",url_scheme="http",le="128"} 1`)
+	// 100 headers of over 512 bytes each, so the sample is above 32KB but below 64KB
+	assert.Contains(t, body, `http_server_request_header_size_bytes_bucket{http_request_method="GET",http_response_status_code="200",http_route="/test",url_scheme="http",le="32768"} 0`)
+	assert.Contains(t, body, `http_server_request_header_size_bytes_bucket{http_request_method="GET",http_response_status_code="200",http_route="/test",url_scheme="http",le="65536"} 1`)
+}
+
+func TestWithSerializerAttribute(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:                customRegistry,
+		WithSerializerAttribute: true,
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	e.GET("/json", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, "OK")
+	})
+	e.GET("/xml", func(c echo.Context) error {
+		return c.XML(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/json"))
+	assert.Equal(t, http.StatusOK, request(e, "/xml"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/json",response_serializer="json",url_scheme="http"} 1`)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/xml",response_serializer="xml",url_scheme="http"} 1`)
+}
+
+func TestRecordAsyncDropsWhenBufferFull(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:              customRegistry,
+		RecordAsync:           true,
+		RecordAsyncBufferSize: 1,
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	e.GET("/test", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	// block the worker with the first record and fill the buffer with the second one
+	block := make(chan struct{})
+	prom.records <- func(ctx context.Context) { <-block }
+	prom.records <- func(ctx context.Context) {}
+
+	assert.Equal(t, http.StatusOK, request(e, "/test"))
+	assert.Equal(t, http.StatusOK, request(e, "/test"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "metrics_dropped_total 2")
+	assert.NotContains(t, body, `http_route="/test"`)
+	close(block)
+}
+
+func TestAttributeScrubber(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	emailRe := regexp.MustCompile(`[^/@]+@[^/@]+\.[a-z]+`)
+	prom := New(MiddlewareConfig{
+		Registry: customRegistry,
+		RequestCounterURLLabelMappingFunc: func(c echo.Context) string {
+			return c.Request().URL.Path
+		},
+		// the attributes of the counter only are appended to a copy of the duration histogram ones
+		WithTrailersAttribute: true,
+		AttributeScrubber: func(key attribute.Key, value string) string {
+			if key == ErrorType {
+				// marks the value once per scrubbing
+				return value + "!"
+			}
+			return emailRe.ReplaceAllString(value, "<email>")
+		},
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	e.GET("/users/:email", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+	e.GET("/fail", func(c echo.Context) error {
+		return errors.New("failed")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/users/alice@example.com"))
+	assert.Equal(t, http.StatusInternalServerError, request(e, "/fail"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{has_trailers="false",http_request_method="GET",http_response_status_code="200",http_route="/users/<email>",url_scheme="http"} 1`)
+	assert.NotContains(t, body, "alice@example.com")
+	// error.type is scrubbed exactly once, on the counter and the duration histogram alike
+	assert.Contains(t, body, `requests_total{error_type="*errors.errorString!",has_trailers="false",http_request_method="GET",http_response_status_code="500",http_route="/fail",url_scheme="http"} 1`)
+	assert.Contains(t, body, `http_server_request_duration_seconds_count{error_type="*errors.errorString!",http_request_method="GET",http_response_status_code="500",http_route="/fail",url_scheme="http"} 1`)
+}
+
+func TestLogicalErrorContextKey(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:               customRegistry,
+		LogicalErrorContextKey: "logical_error",
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	e.GET("/ok", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, "OK")
+	})
+	e.GET("/logical_error", func(c echo.Context) error {
+		c.Set("logical_error", true)
+		return c.JSON(http.StatusOK, map[string]string{"error": "insufficient funds"})
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/ok"))
+	assert.Equal(t, http.StatusOK, request(e, "/logical_error"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/ok",outcome="success",url_scheme="http"} 1`)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/logical_error",outcome="error",url_scheme="http"} 1`)
+}
+
+func TestPreflightAndConnectRouteLabel(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:            customRegistry,
+		PreflightRouteLabel: RouteLabelCollapse,
+		ConnectRouteLabel:   RouteLabelSkip,
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	e.GET("/api", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	req := httptest.NewRequest(http.MethodOptions, "/api", nil)
+	req.Header.Set(echo.HeaderOrigin, "https://example.com")
+	req.Header.Set(echo.HeaderAccessControlRequestMethod, http.MethodGet)
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	req = httptest.NewRequest(http.MethodConnect, "/api", nil)
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="OPTIONS",http_response_status_code="204",http_route="<preflight>",url_scheme="http"} 1`)
+	assert.NotContains(t, body, `http_request_method="CONNECT"`)
+}
+
+func TestCustomReader(t *testing.T) {
+	e := echo.New()
+	reader := sdkmetric.NewManualReader()
+	prom := New(MiddlewareConfig{
+		Registry: prometheus.NewRegistry(),
+		Reader:   reader,
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	e.GET("/test", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/test"))
+	assert.Equal(t, http.StatusNotFound, request(e, "/metrics"))
+
+	var rm metricdata.ResourceMetrics
+	assert.NoError(t, reader.Collect(context.Background(), &rm))
+	names := make([]string, 0)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			names = append(names, m.Name)
+		}
+	}
+	assert.Contains(t, names, "requests")
+	assert.Contains(t, names, MetricHTTPServerRequestDuration)
+}
+
+func TestWithConfigInfo(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:                customRegistry,
+		WithConfigInfo:          true,
+		WithSerializerAttribute: true,
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "echo_otel_metrics_config_info{")
+	assert.Contains(t, body, `with_config_info="true"`)
+	assert.Contains(t, body, `with_serializer_attribute="true"`)
+	assert.Contains(t, body, `record_async="false"`)
+	assert.Contains(t, body, `with_request_url_and_header_size="false"`)
+}
+
+func TestNewWithError(t *testing.T) {
+	_, err := NewWithError(MiddlewareConfig{
+		Registry:     prometheus.NewRegistry(),
+		ExporterKind: ExporterKind(-1),
+	})
+	assert.ErrorContains(t, err, "failed to create ExporterKind(-1) exporter: unsupported exporter kind")
+}
+
+func TestExportFilter(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry: customRegistry,
+		ExportFilter: func(metricName string) bool {
+			return metricName != "http_server_response_body_size_bytes"
+		},
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	assert.Equal(t, http.StatusNotFound, request(e, "/ping"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "http_server_request_body_size_bytes")
+	assert.NotContains(t, body, "http_server_response_body_size_bytes")
+
+	mfs, err := customRegistry.Gather()
+	assert.NoError(t, err)
+	names := make([]string, 0, len(mfs))
+	for _, mf := range mfs {
+		names = append(names, exportedName(mf))
+	}
+	assert.Contains(t, names, "http_server_response_body_size_bytes")
+}
+
+func TestEndpointType(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:        customRegistry,
+		StreamingRoutes: []string{"/events"},
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	e.GET("/events", func(c echo.Context) error {
+		return c.String(http.StatusOK, "data: hello\n\n")
+	})
+	e.GET("/users", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/events"))
+	assert.Equal(t, http.StatusOK, request(e, "/users"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{endpoint_type="stream",http_request_method="GET",http_response_status_code="200",http_route="/events",url_scheme="http"} 1`)
+	assert.Contains(t, body, `requests_total{endpoint_type="rest",http_request_method="GET",http_response_status_code="200",http_route="/users",url_scheme="http"} 1`)
+}
+
+func TestCustomBuckets(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:            customRegistry,
+		DurationBuckets:     []float64{0.0001, 0.001},
+		ResponseSizeBuckets: []float64{1 << 30},
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	assert.Equal(t, http.StatusNotFound, request(e, "/ping"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `http_server_request_duration_seconds_bucket{http_request_method="GET",http_response_status_code="404",http_route="",url_scheme="http",le="0.0001"} 1`)
+	assert.NotContains(t, body, `http_server_request_duration_seconds_bucket{http_request_method="GET",http_response_status_code="404",http_route="",url_scheme="http",le="0.005"}`)
+	assert.Contains(t, body, `http_server_response_body_size_bytes_bucket{http_request_method="GET",http_response_status_code="404",http_route="",url_scheme="http",le="1.073741824e+09"} 1`)
+	// request size keeps the defaults
+	assert.Contains(t, body, `http_server_request_body_size_bytes_bucket{http_request_method="GET",http_response_status_code="404",http_route="",url_scheme="http",le="10240"} 1`)
+}
+
+func TestMetricsErrorAsJSON(t *testing.T) {
+	e := echo.New()
+	prom := New(MiddlewareConfig{
+		Registerer: prometheus.NewRegistry(),
+		Gatherer: prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return nil, errors.New("collector is broken")
+		}),
+		MetricsErrorAsJSON: true,
+	})
+	e.GET("/metrics", prom.ExporterHandler())
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, echo.MIMEApplicationJSON, rec.Header().Get(echo.HeaderContentType))
+	assert.JSONEq(t, `{"error": "An error has occurred while serving metrics:\n\ncollector is broken"}`, rec.Body.String())
+}
+
+func TestErrorTypeForGoErrors(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	e.GET("/handler_for_go_error", func(c echo.Context) error {
+		return io.ErrUnexpectedEOF
+	})
+
+	assert.Equal(t, http.StatusInternalServerError, request(e, "/handler_for_go_error"))
+	assert.Equal(t, http.StatusNotFound, request(e, "/ping"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{error_type="*errors.errorString",http_request_method="GET",http_response_status_code="500",http_route="/handler_for_go_error",url_scheme="http"} 1`)
+	// 4xx are not server errors
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="404",http_route="",url_scheme="http"} 1`)
+}
+
+func TestWithSetCookieCount(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:           customRegistry,
+		WithSetCookieCount: true,
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	e.GET("/login", func(c echo.Context) error {
+		c.SetCookie(&http.Cookie{Name: "session", Value: "1"})
+		c.SetCookie(&http.Cookie{Name: "csrf", Value: "2"})
+		c.SetCookie(&http.Cookie{Name: "tracking", Value: "3"})
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/login"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `http_server_response_set_cookie_count_sum{http_request_method="GET",http_response_status_code="200",http_route="/login",url_scheme="http"} 3`)
+	assert.Contains(t, body, `http_server_response_set_cookie_count_bucket{http_request_method="GET",http_response_status_code="200",http_route="/login",url_scheme="http",le="2"} 0`)
+	assert.Contains(t, body, `http_server_response_set_cookie_count_bucket{http_request_method="GET",http_response_status_code="200",http_route="/login",url_scheme="http",le="3"} 1`)
+}
+
+func TestActiveRequestsBalancedOnPanic(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry: customRegistry,
+		RequestCounterURLLabelMappingFunc: func(c echo.Context) string {
+			if c.Path() == "/broken-label" {
+				panic("label mapping is broken")
+			}
+			return c.Path()
+		},
+	})
+	e.Use(middleware.Recover())
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/panic", func(c echo.Context) error {
+		panic("boom")
+	})
+	e.GET("/broken-label", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusInternalServerError, request(e, "/panic"))
+	// the response is committed before the recording panics
+	assert.Equal(t, http.StatusOK, request(e, "/broken-label"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	// nothing is in flight, the scrape itself is not recorded
+	assert.Contains(t, body, `http_server_active_requests{http_request_method="GET",server_address="example.com",url_scheme="http"} 0`)
+}
+
+func TestMetricsForPanics(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry})
+	// Recover is placed before the metrics middleware, so the panic unwinds through it
+	e.Use(middleware.Recover())
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	e.GET("/handler_for_panic", func(c echo.Context) error {
+		panic("boom")
+	})
+
+	assert.Equal(t, http.StatusInternalServerError, request(e, "/handler_for_panic"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{error_type="panic",http_request_method="GET",http_response_status_code="500",http_route="/handler_for_panic",url_scheme="http"} 1`)
+	assert.Contains(t, body, `http_server_request_duration_seconds_count{error_type="panic",http_request_method="GET",http_response_status_code="500",http_route="/handler_for_panic",url_scheme="http"} 1`)
+	assert.Contains(t, body, `http_server_active_requests{http_request_method="GET",server_address="example.com",url_scheme="http"} 0`)
+}
+
+func TestWithServerPort(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:       customRegistry,
+		WithServerPort: true,
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	e.GET("/test", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/test"))
+	req := httptest.NewRequest(http.MethodGet, "http://example.com:8080/test", nil)
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/test",server_port="80",url_scheme="http"} 1`)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/test",server_port="8080",url_scheme="http"} 1`)
+}
+
+func TestRouteTemplateResolver(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry: customRegistry,
+		RequestCounterURLLabelMappingFunc: func(c echo.Context) string {
+			return "/mapped"
+		},
+		RouteTemplateResolver: func(c echo.Context) string {
+			return "/upstream/:id"
+		},
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	e.GET("/proxy/*", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/proxy/upstream/42"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/upstream/:id",url_scheme="http"} 1`)
+	assert.NotContains(t, body, `http_route="/proxy/*"`)
+	assert.NotContains(t, body, `http_route="/mapped"`)
+}
+
+func TestTrimmedDurationThreshold(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:                 customRegistry,
+		TrimmedDurationThreshold: 5 * time.Millisecond,
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	e.GET("/slow", func(c echo.Context) error {
+		time.Sleep(50 * time.Millisecond)
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/slow"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	labels := `{http_request_method="GET",http_response_status_code="200",http_route="/slow",url_scheme="http"}`
+	assert.GreaterOrEqual(t, sampleValue(t, body, "http_server_request_duration_seconds_sum"+labels), 0.05)
+	assert.Equal(t, 0.005, sampleValue(t, body, "http_server_request_duration_trimmed_seconds_sum"+labels))
+	assert.Equal(t, 1.0, sampleValue(t, body, "http_server_request_duration_clamped_total"+labels))
+}
+
+func TestWithProtocolVersion(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:            customRegistry,
+		WithProtocolVersion: true,
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	e.GET("/test", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/test"))
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/test",network_protocol_name="http",network_protocol_version="1.1",url_scheme="http"} 1`)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/test",network_protocol_name="http",network_protocol_version="2",url_scheme="http"} 1`)
+}
+
+func TestPreMiddleware(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry})
+	e.Pre(prom.PreMiddleware())
+	e.Pre(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if c.Request().Header.Get("X-Evil") != "" {
+				return echo.ErrForbidden
+			}
+			return next(c)
+		}
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	e.GET("/test", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/test"))
+	assert.Equal(t, http.StatusNotFound, request(e, "/ping"))
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.Header.Set("X-Evil", "1")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/test",url_scheme="http"} 1`)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="404",http_route="",url_scheme="http"} 1`)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="403",http_route="<pre-rejected>",url_scheme="http"} 1`)
+}
+
+func TestDisabledAttributes(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:             customRegistry,
+		EnableServerAddrPort: true,
+		DisabledAttributes:   []attribute.Key{ServerAddress, URLScheme},
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	assert.Equal(t, http.StatusNotFound, request(e, "/ping"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="404",http_route="",server_port="80"} 1`)
+	assert.Contains(t, body, `http_server_request_duration_seconds_count{http_request_method="GET",http_response_status_code="404",http_route="",server_port="80"} 1`)
+	assert.Contains(t, body, `http_server_active_requests{http_request_method="GET"} 0`)
+	assert.NotContains(t, body, "server_address=")
+	assert.NotContains(t, body, "url_scheme=")
+}
+
+func TestMaxScrapeBytes(t *testing.T) {
+	e := echo.New()
+	var logs strings.Builder
+	e.Logger.SetOutput(&logs)
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry: customRegistry,
+		RequestCounterURLLabelMappingFunc: func(c echo.Context) string {
+			return c.Request().URL.Path
+		},
+		MaxScrapeBytes: 64 * 1024,
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	for i := 0; i < 200; i++ {
+		assert.Equal(t, http.StatusNotFound, request(e, fmt.Sprintf("/not-found/%d", i)))
+	}
+
+	var full strings.Builder
+	assert.NoError(t, WriteGatheredMetrics(&full, customRegistry))
+	assert.Greater(t, full.Len(), 64*1024)
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusInternalServerError, code)
+	assert.Equal(t, "scrape response exceeds MaxScrapeBytes", body)
+	assert.Contains(t, logs.String(), "metrics scrape failed: scrape response exceeds MaxScrapeBytes")
+
+	// below the limit the scrape is served in full
+	small := New(MiddlewareConfig{
+		Registry:       prometheus.NewRegistry(),
+		MaxScrapeBytes: full.Len() * 2,
+	})
+	e2 := echo.New()
+	e2.Use(small.Middleware())
+	e2.GET("/metrics", small.ExporterHandler())
+	assert.Equal(t, http.StatusNotFound, request(e2, "/ping"))
+	body, code = requestBody(e2, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "http_server_request_duration_seconds")
+}
+
+func TestAdditionalAttributes(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry: customRegistry,
+		AdditionalAttributes: func(c echo.Context) []attribute.KeyValue {
+			tenant, ok := c.Get("tenant").(string)
+			if !ok {
+				return nil
+			}
+			return []attribute.KeyValue{attribute.String("tenant", tenant)}
+		},
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	e.GET("/test", func(c echo.Context) error {
+		c.Set("tenant", "acme")
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/test"))
+	assert.Equal(t, http.StatusNotFound, request(e, "/ping"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/test",tenant="acme",url_scheme="http"} 1`)
+	assert.Contains(t, body, `http_server_request_duration_seconds_count{http_request_method="GET",http_response_status_code="200",http_route="/test",tenant="acme",url_scheme="http"} 1`)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="404",http_route="",url_scheme="http"} 1`)
+}
+
+func TestWithStatusClass(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:           customRegistry,
+		WithStatusClass:    true,
+		DisabledAttributes: []attribute.Key{HttpResponseStatusCode},
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	assert.Equal(t, http.StatusNotFound, request(e, "/ping"))
+	assert.Equal(t, http.StatusNotFound, request(e, "/pong"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_class="4xx",http_route="",url_scheme="http"} 2`)
+	assert.NotContains(t, body, "http_response_status_code=")
+}
+
+func TestStatusClass(t *testing.T) {
+	assert.Equal(t, "1xx", statusClass(http.StatusSwitchingProtocols))
+	assert.Equal(t, "2xx", statusClass(http.StatusOK))
+	assert.Equal(t, "3xx", statusClass(http.StatusFound))
+	assert.Equal(t, "4xx", statusClass(http.StatusNotFound))
+	assert.Equal(t, "5xx", statusClass(http.StatusBadGateway))
+	assert.Equal(t, "unknown", statusClass(0))
+}
+
+func TestSetReady(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	e.GET("/test", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/test"))
+	prom.SetReady(false)
+	assert.Equal(t, http.StatusOK, request(e, "/test"))
+	prom.SetReady(true)
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/test",url_scheme="http"} 2`)
+	assert.Contains(t, body, `http_server_requests_not_ready_total{http_request_method="GET",http_response_status_code="200",http_route="/test",url_scheme="http"} 1`)
+}
+
+func TestNotFoundPathSegments(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:             customRegistry,
+		NotFoundPathSegments: []string{"admin", "wp-admin"},
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	assert.Equal(t, http.StatusNotFound, request(e, "/admin/x"))
+	assert.Equal(t, http.StatusNotFound, request(e, "/random/y"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="404",http_route="admin",url_scheme="http"} 1`)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="404",http_route="<other>",url_scheme="http"} 1`)
+}
+
+func TestUnmatchedRouteLabel(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:            customRegistry,
+		UnmatchedRouteLabel: "<unmatched>",
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	assert.Equal(t, http.StatusNotFound, request(e, "/nope"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="404",http_route="<unmatched>",url_scheme="http"} 1`)
+}
+
+func TestRouteNormalizer(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:            customRegistry,
+		UnmatchedRouteLabel: "<unmatched>",
+		RouteNormalizer:     NormalizeRoutePath,
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	assert.Equal(t, http.StatusNotFound, request(e, "/favicon.ico"))
+	assert.Equal(t, http.StatusNotFound, request(e, "/orders/1?x=1"))
+	assert.Equal(t, http.StatusNotFound, request(e, "/orders/22"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="404",http_route="/favicon.ico",url_scheme="http"} 1`)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="404",http_route="/orders/:num",url_scheme="http"} 2`)
+}
+
+func TestSkipRouteMetrics(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	SkipRouteMetrics(e.GET("/healthz", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	}))
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/healthz"))
+	assert.Equal(t, http.StatusOK, request(e, "/healthz"))
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotContains(t, body, `http_route="/healthz"`)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http"} 1`)
+	assert.Contains(t, body, `http_server_active_requests{http_request_method="GET",server_address="example.com",url_scheme="http"} 0`)
+
+	// arbitrary methods on a matched route do not grow the cache
+	for i := 0; i < 100; i++ {
+		req := httptest.NewRequest(fmt.Sprintf("M%d", i), "/ping", nil)
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	entries := 0
+	prom.optedOutRoutes.Range(func(_, _ any) bool {
+		entries++
+		return true
+	})
+	assert.LessOrEqual(t, entries, 4)
+}
+
+func TestCacheResultHeader(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:          customRegistry,
+		CacheResultHeader: "X-Cache",
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/cached", func(c echo.Context) error {
+		c.Response().Header().Set("X-Cache", "HIT")
+		return c.String(http.StatusOK, "OK")
+	})
+	e.GET("/uncached", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/cached"))
+	assert.Equal(t, http.StatusOK, request(e, "/uncached"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{cache_result="hit",http_request_method="GET",http_response_status_code="200",http_route="/cached",url_scheme="http"} 1`)
+	assert.Contains(t, body, `requests_total{cache_result="bypass",http_request_method="GET",http_response_status_code="200",http_route="/uncached",url_scheme="http"} 1`)
+}
+
+func TestDisableSizeMetrics(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:           customRegistry,
+		DisableSizeMetrics: true,
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http"} 1`)
+	assert.NotContains(t, body, "_body_size_bytes")
+}
+
+func TestIgnorePaths(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:    customRegistry,
+		IgnorePaths: []string{"/healthz", "/static/*", "/favicon.ico"},
+		Skipper: func(c echo.Context) bool {
+			return c.Path() == "/skipped"
+		},
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	for _, route := range []string{"/healthz", "/static/:file", "/skipped", "/ping"} {
+		e.GET(route, func(c echo.Context) error {
+			return c.String(http.StatusOK, "OK")
+		})
+	}
+
+	assert.Equal(t, http.StatusOK, request(e, "/healthz"))
+	assert.Equal(t, http.StatusOK, request(e, "/static/app.js"))
+	assert.Equal(t, http.StatusOK, request(e, "/skipped"))
+	assert.Equal(t, http.StatusNotFound, request(e, "/favicon.ico"))
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotContains(t, body, `http_route="/healthz"`)
+	assert.NotContains(t, body, `http_route="/static/:file"`)
+	assert.NotContains(t, body, `http_route="/skipped"`)
+	assert.NotContains(t, body, `http_response_status_code="404"`)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http"} 1`)
+
+	_, err := NewWithError(MiddlewareConfig{Registry: prometheus.NewRegistry(), IgnorePaths: []string{"["}})
+	assert.Error(t, err)
+}
+
+func TestCounterSampleRoutes(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:            customRegistry,
+		CounterSampleRoutes: map[string]int{"/hot": 10},
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	for _, route := range []string{"/hot", "/cold"} {
+		e.GET(route, func(c echo.Context) error {
+			return c.String(http.StatusOK, "OK")
+		})
+	}
+
+	for i := 0; i < 1005; i++ {
+		assert.Equal(t, http.StatusOK, request(e, "/hot"))
+	}
+	for i := 0; i < 7; i++ {
+		assert.Equal(t, http.StatusOK, request(e, "/cold"))
+	}
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.InDelta(t, 1005, sampleValue(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/hot",url_scheme="http"}`), 10)
+	assert.Equal(t, float64(7), sampleValue(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/cold",url_scheme="http"}`))
+}
+
+func TestGraphitePush(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	// the listener outlives the pushes, nobody reads lines once the test returned
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+		listener.Close()
+	})
+
+	lines := make(chan string, 1024)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				select {
+				case lines <- scanner.Text():
+				case <-done:
+					conn.Close()
+					return
+				}
+			}
+			conn.Close()
+		}
+	}()
+
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry})
+	e.Use(prom.Middleware())
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+
+	_, err = prom.GraphitePush(context.Background(), listener.Addr().String(), "app", 0)
+	assert.ErrorContains(t, err, "invalid graphite push interval 0s")
+
+	stop, err := prom.GraphitePush(context.Background(), listener.Addr().String(), "app", 10*time.Millisecond)
+	assert.NoError(t, err)
+	defer stop()
+
+	want := "app.requests_total;http_request_method=GET;http_response_status_code=200;http_route=/ping;url_scheme=http 1 "
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line := <-lines:
+			if strings.HasPrefix(line, want) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no %q line pushed", want)
+		}
+	}
+}
+
+func TestRequestSizeFunc(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry: customRegistry,
+		RequestSizeFunc: func(r *http.Request) int {
+			return int(r.ContentLength)
+		},
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.POST("/upload", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("hello"))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `http_server_request_body_size_bytes_sum{http_request_method="POST",http_response_status_code="200",http_route="/upload",url_scheme="http"} 5`)
+}
+
+func TestClientCertAttribute(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:                customRegistry,
+		WithClientCertAttribute: true,
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/ping", nil)
+	req.TLS.PeerCertificates = []*x509.Certificate{{}}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{client_cert_present="true",http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="https"} 1`)
+	assert.Contains(t, body, `requests_total{client_cert_present="false",http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http"} 1`)
+}
+
+func TestResponseSizeHijackedAndStreamed(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/hijack", func(c echo.Context) error {
+		conn, rw, err := c.Response().Hijack()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, _ = rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nOK")
+		return rw.Flush()
+	})
+	e.GET("/stream", func(c echo.Context) error {
+		c.Response().Writer.WriteHeader(http.StatusOK)
+		_, err := c.Response().Writer.Write([]byte("hello"))
+		return err
+	})
+
+	server := httptest.NewServer(e)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/hijack")
+	assert.NoError(t, err)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, request(e, "/stream"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/hijack",url_scheme="http"} 1`)
+	assert.NotContains(t, body, `http_server_response_body_size_bytes_count{http_request_method="GET",http_response_status_code="200",http_route="/hijack"`)
+	assert.Contains(t, body, `http_server_response_body_size_bytes_sum{http_request_method="GET",http_response_status_code="200",http_route="/stream",url_scheme="http"} 5`)
+}
+
+func TestBuildInfo(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:       customRegistry,
+		ServiceVersion: "v1.2.3",
+		WithBuildInfo:  true,
+	})
+	e.GET("/metrics", prom.ExporterHandler())
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Regexp(t, `http_server_build_info\{commit="[^"]+",go_version="`+regexp.QuoteMeta(runtime.Version())+`",service_version="v1.2.3"\} 1`, body)
+}
+
+func TestReload(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:        customRegistry,
+		DurationBuckets: []float64{0.1, 1},
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+	body, _ := requestBody(e, "/metrics")
+	assert.Contains(t, body, `http_server_request_duration_seconds_bucket{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http",le="0.1"} 1`)
+
+	assert.NoError(t, prom.Reload(MiddlewareConfig{
+		Registry:        customRegistry,
+		DurationBuckets: []float64{0.2, 2},
+	}))
+
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `http_server_request_duration_seconds_bucket{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http",le="0.2"} 1`)
+	assert.NotContains(t, body, `le="0.1"`)
+	assert.Equal(t, float64(1), sampleValue(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http"}`))
+
+	// a failed reload keeps the current instruments
+	assert.Error(t, prom.Reload(MiddlewareConfig{Registry: customRegistry, IgnorePaths: []string{"["}}))
+	body, _ = requestBody(e, "/metrics")
+	assert.Contains(t, body, `le="0.2"`)
+}
+
+func TestBotAttribute(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:         customRegistry,
+		WithBotAttribute: true,
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/page", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	for _, userAgent := range []string{
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/page", nil)
+		req.Header.Set("User-Agent", userAgent)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{client_is_bot="true",http_request_method="GET",http_response_status_code="200",http_route="/page",url_scheme="http"} 1`)
+	assert.Contains(t, body, `requests_total{client_is_bot="false",http_request_method="GET",http_response_status_code="200",http_route="/page",url_scheme="http"} 1`)
+}
+
+func TestRuntimeMetrics(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:           customRegistry,
+		WithRuntimeMetrics: true,
+	})
+	e.GET("/metrics", prom.ExporterHandler())
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Regexp(t, `(?m)^process_runtime_go_goroutines [0-9]+$`, body)
+}
+
+func TestSetup(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry, MetricsPath: "/internal/metrics"})
+	prom.Setup(e)
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+
+	body, code := requestBody(e, "/internal/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http"} 1`)
+}
+
+func TestResetEndpoint(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry, EnableResetEndpoint: true})
+	prom.Setup(e)
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+	body, _ := requestBody(e, "/metrics")
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http"} 1`)
+
+	req := httptest.NewRequest(http.MethodPost, "/metrics/reset", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotContains(t, body, `http_route="/ping"`)
+
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+	body, _ = requestBody(e, "/metrics")
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http"} 1`)
+
+	// repeated resets must not pile up RecordAsync workers
+	e = echo.New()
+	prom = New(MiddlewareConfig{Registry: prometheus.NewRegistry(), EnableResetEndpoint: true, RecordAsync: true})
+	prom.Setup(e)
+	before := runtime.NumGoroutine()
+	for range 10 {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/metrics/reset", nil))
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+	}
+	assertGoroutinesAtMost(t, before)
+}
+
+func TestBindDurationContextKey(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:               customRegistry,
+		BindDurationContextKey: "bind_duration",
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/bind", func(c echo.Context) error {
+		c.Set("bind_duration", 250*time.Millisecond)
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/bind"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `http_server_bind_duration_seconds_sum{http_request_method="GET",http_response_status_code="200",http_route="/bind",url_scheme="http"} 0.25`)
+	assert.Contains(t, body, `http_server_bind_duration_seconds_count{http_request_method="GET",http_response_status_code="200",http_route="/bind",url_scheme="http"} 1`)
+	assert.NotContains(t, body, `http_server_bind_duration_seconds_count{http_request_method="GET",http_response_status_code="200",http_route="/metrics"`)
+}
+
+func TestSetupListenAddress(t *testing.T) {
+	e := echo.New()
+	metricsRouter := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:      customRegistry,
+		ListenAddress: "127.0.0.1:0",
+		MetricsRouter: metricsRouter,
+	})
+	prom.Setup(e)
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+	assert.Equal(t, http.StatusNotFound, request(e, "/metrics"))
+
+	assert.Eventually(t, func() bool { return metricsRouter.ListenerAddr() != nil }, 5*time.Second, 10*time.Millisecond)
+	metricsURL := "http://" + metricsRouter.ListenerAddr().String() + "/metrics"
+	resp, err := http.Get(metricsURL)
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http"} 1`)
+
+	assert.NoError(t, e.Shutdown(context.Background()))
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get(metricsURL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestExemplars(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:      customRegistry,
+		WithExemplars: true,
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/traced", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	traceID, _ := trace.TraceIDFromHex("0102030405060708090a0b0c0d0e0f10")
+	spanID, _ := trace.SpanIDFromHex("0102030405060708")
+	spanContext := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	})
+	req := httptest.NewRequest(http.MethodGet, "/traced", nil)
+	req = req.WithContext(trace.ContextWithSpanContext(req.Context(), spanContext))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text")
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	// the order of the exemplar labels is not stable
+	bucket := `http_server_request_duration_seconds_bucket\{http_request_method="GET",http_response_status_code="200",http_route="/traced",url_scheme="http",le="0.005"\} 1 # \{[^}]*`
+	assert.Regexp(t, bucket+`trace_id="0102030405060708090a0b0c0d0e0f10"`, rec.Body.String())
+	assert.Regexp(t, bucket+`span_id="0102030405060708"`, rec.Body.String())
+}
+
+func TestPromoteInstanceLabel(t *testing.T) {
+	t.Setenv("OTEL_RESOURCE_ATTRIBUTES", "service.instance.id=pod-1")
+
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:             customRegistry,
+		PromoteInstanceLabel: true,
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/ping",service_instance_id="pod-1",url_scheme="http"} 1`)
+}
+
+func TestNameSanitizer(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:      customRegistry,
+		NameSanitizer: strings.ToUpper,
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `REQUESTS_TOTAL{HTTP_REQUEST_METHOD="GET",HTTP_RESPONSE_STATUS_CODE="200",HTTP_ROUTE="/ping",URL_SCHEME="http"} 1`)
+	assert.Contains(t, body, `HTTP_SERVER_REQUEST_DURATION_SECONDS_count{HTTP_REQUEST_METHOD="GET",HTTP_RESPONSE_STATUS_CODE="200",HTTP_ROUTE="/ping",URL_SCHEME="http"} 1`)
+	assert.NotContains(t, body, "requests_total")
+}
+
+func TestTraceSampledAttribute(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:                  customRegistry,
+		WithTraceSampledAttribute: true,
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	traceID, _ := trace.TraceIDFromHex("0102030405060708090a0b0c0d0e0f10")
+	spanID, _ := trace.SpanIDFromHex("0102030405060708")
+	spanContext := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	})
+	req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+	req = req.WithContext(trace.ContextWithSpanContext(req.Context(), spanContext))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `http_server_request_duration_seconds_count{http_request_method="GET",http_response_status_code="200",http_route="/ping",trace_sampled="true",url_scheme="http"} 1`)
+	assert.Contains(t, body, `http_server_request_duration_seconds_count{http_request_method="GET",http_response_status_code="200",http_route="/ping",trace_sampled="false",url_scheme="http"} 1`)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http"} 2`)
+}
+
+func TestWriteTimeout(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:     customRegistry,
+		WriteTimeout: 20 * time.Millisecond,
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/slow", func(c echo.Context) error {
+		time.Sleep(25 * time.Millisecond)
+		return c.String(http.StatusOK, "too late")
+	})
+
+	// the server closed the connection at the write deadline
+	rec := &failingResponseWriter{ResponseRecorder: httptest.NewRecorder(), err: errors.New("i/o timeout")}
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/slow", nil))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `http_server_write_timeout_total{http_route="/slow"} 1`)
+}
+
+// failingResponseWriter fails every body write with err
+type failingResponseWriter struct {
+	*httptest.ResponseRecorder
+	err error
+}
+
+func (w *failingResponseWriter) Write([]byte) (int, error) {
+	return 0, w.err
+}
+
+func TestResourceAttributes(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:           customRegistry,
+		ServiceName:        "svc",
+		ResourceAttributes: []attribute.KeyValue{attribute.String("deployment.environment", "staging")},
+	})
+	e.GET("/metrics", prom.ExporterHandler())
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Regexp(t, `target_info\{deployment_environment="staging",service_name="svc",`, body)
+
+	e = echo.New()
+	customRegistry = prometheus.NewRegistry()
+	prom = New(MiddlewareConfig{
+		Registry: customRegistry,
+		Resource: resource.NewSchemaless(attribute.String("service.name", "custom")),
+	})
+	e.GET("/metrics", prom.ExporterHandler())
+
+	body, code = requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `target_info{service_name="custom"} 1`)
+}
+
+func TestRegisterRouteConcurrency(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry})
+	e.GET("/metrics", prom.ExporterHandler())
+
+	var inFlight atomic.Int64
+	inFlight.Store(3)
+	prom.RegisterRouteConcurrency("/upload", inFlight.Load, func() int64 { return 4 })
+	prom.RegisterRouteConcurrency("/unlimited", inFlight.Load, func() int64 { return 0 })
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 0.75, sampleValue(t, body, `http_server_route_concurrency_utilization_ratio{http_route="/upload"}`))
+	assert.NotContains(t, body, `http_route="/unlimited"`)
+
+	inFlight.Store(1)
+	body, _ = requestBody(e, "/metrics")
+	assert.Equal(t, 0.25, sampleValue(t, body, `http_server_route_concurrency_utilization_ratio{http_route="/upload"}`))
+
+	// the routes are carried over before a scrape can reach the exporter of the new instance
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 50 {
+			body, _ := requestBody(e, "/metrics")
+			assert.Contains(t, body, `http_server_route_concurrency_utilization_ratio{http_route="/upload"} 0.25`)
+		}
+	}()
+	for range 20 {
+		assert.NoError(t, prom.Reload(prom.Config()))
+	}
+	wg.Wait()
+}
+
+func TestWithoutUnits(t *testing.T) {
+	for _, withoutUnits := range []bool{false, true} {
+		e := echo.New()
+		customRegistry := prometheus.NewRegistry()
+		prom := New(MiddlewareConfig{Registry: customRegistry, WithoutUnits: withoutUnits})
+		e.Use(prom.Middleware())
+		e.GET("/metrics", prom.ExporterHandler())
+		e.GET("/ping", func(c echo.Context) error {
+			return c.String(http.StatusOK, "OK")
+		})
+
+		assert.Equal(t, http.StatusOK, request(e, "/ping"))
+		body, code := requestBody(e, "/metrics")
+		assert.Equal(t, http.StatusOK, code)
+		if withoutUnits {
+			assert.Contains(t, body, "http_server_request_duration_bucket{")
+			assert.Contains(t, body, "http_server_response_body_size_bucket{")
+			assert.NotContains(t, body, "http_server_request_duration_seconds")
+		} else {
+			assert.Contains(t, body, "http_server_request_duration_seconds_bucket{")
+			assert.Contains(t, body, "http_server_response_body_size_bytes_bucket{")
+		}
+		assert.Contains(t, body, "requests_total{")
+	}
+}
+
+func TestScopeName(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:          customRegistry,
+		WithScopeInfo:     true,
+		ScopeName:         "api",
+		ScopeVersion:      "v2.0.0",
+		WithoutTargetInfo: true,
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/ping",otel_scope_name="api",otel_scope_version="v2.0.0",url_scheme="http"} 1`)
+	assert.NotContains(t, body, "target_info")
+}
+
+func TestWithoutCounterSuffixes(t *testing.T) {
+	for _, withoutSuffixes := range []bool{false, true} {
+		e := echo.New()
+		customRegistry := prometheus.NewRegistry()
+		prom := New(MiddlewareConfig{Registry: customRegistry, WithoutCounterSuffixes: withoutSuffixes})
+		e.Use(prom.Middleware())
+		e.GET("/metrics", prom.ExporterHandler())
+		e.GET("/ping", func(c echo.Context) error {
+			return c.String(http.StatusOK, "OK")
+		})
+
+		assert.Equal(t, http.StatusOK, request(e, "/ping"))
+		body, code := requestBody(e, "/metrics")
+		assert.Equal(t, http.StatusOK, code)
+		if withoutSuffixes {
+			assert.Contains(t, body, "\nrequests{")
+			assert.NotContains(t, body, "requests_total")
+		} else {
+			assert.Contains(t, body, "\nrequests_total{")
+		}
+		// the histograms keep their unit suffix either way
+		assert.Contains(t, body, "http_server_request_duration_seconds_bucket{")
+	}
+}
+
+func TestUncompressedCompressible(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry, UncompressedCompressibleThreshold: 1024})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	large := map[string]string{"data": strings.Repeat("a", 4096)}
+	e.GET("/json", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, large)
+	})
+	e.GET("/small", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, map[string]string{"data": "a"})
+	})
+	e.GET("/binary", func(c echo.Context) error {
+		return c.Blob(http.StatusOK, "application/octet-stream", make([]byte, 4096))
+	})
+	e.GET("/gzip", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, large)
+	}, middleware.Gzip())
+
+	assert.Equal(t, http.StatusOK, request(e, "/json"))
+	assert.Equal(t, http.StatusOK, request(e, "/small"))
+	assert.Equal(t, http.StatusOK, request(e, "/binary"))
+	req := httptest.NewRequest(http.MethodGet, "/gzip", nil)
+	req.Header.Set(echo.HeaderAcceptEncoding, "gzip")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, "gzip", rec.Header().Get(echo.HeaderContentEncoding))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(1), sampleValue(t, body, `http_server_response_uncompressed_compressible_total{http_route="/json"}`))
+	assert.NotContains(t, body, `http_server_response_uncompressed_compressible_total{http_route="/small"}`)
+	assert.NotContains(t, body, `http_server_response_uncompressed_compressible_total{http_route="/binary"}`)
+	assert.NotContains(t, body, `http_server_response_uncompressed_compressible_total{http_route="/gzip"}`)
+}
+
+func TestGatherer(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry})
+	e.Use(prom.Middleware())
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+	assert.Equal(t, customRegistry, prom.Gatherer())
+
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+	var buf strings.Builder
+	assert.NoError(t, WriteGatheredMetrics(&buf, prom.Gatherer()))
+	// the raw gatherer carries the UTF-8 names, which ExporterHandler escapes
+	assert.Contains(t, buf.String(), `requests_total{"http.request.method"="GET","http.response.status_code"="200","http.route"="/ping","url.scheme"="http"} 1`)
+}
+
+func TestSnapshot(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry})
+	e.Use(prom.Middleware())
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+	snapshot, err := prom.Snapshot()
+	assert.NoError(t, err)
+
+	series := `{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http"}`
+	assert.Equal(t, float64(2), snapshot["requests_total"+series])
+	assert.Equal(t, float64(2), snapshot["http_server_request_duration_seconds_count"+series])
+	assert.Contains(t, snapshot, "http_server_request_duration_seconds_sum"+series)
+	assert.Equal(t, float64(2), snapshot[`http_server_response_body_size_bytes_bucket{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http",le="1024"}`])
+	assert.Equal(t, float64(2), snapshot[`http_server_request_duration_seconds_bucket{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http",le="+Inf"}`])
+	active := `http_server_active_requests{http_request_method="GET",server_address="example.com",url_scheme="http"}`
+	assert.Contains(t, snapshot, active)
+	assert.Equal(t, float64(0), snapshot[active])
+}
+
+func TestWriteGatheredMetricsOpenMetrics(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry})
+	e.Use(prom.Middleware())
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+	var buf strings.Builder
+	assert.NoError(t, WriteGatheredMetricsOpenMetrics(&buf, prom.Gatherer()))
+	body := buf.String()
+	assert.Contains(t, body, "# TYPE requests counter\n")
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http"} 1.0`)
+	assert.True(t, strings.HasSuffix(body, "# EOF\n"))
+}
+
+func TestMinRecordedDuration(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry, MinRecordedDuration: time.Microsecond})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/noop", func(c echo.Context) error {
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	assert.Equal(t, http.StatusNoContent, request(e, "/noop"))
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.GreaterOrEqual(t, sampleValue(t, body, `http_server_request_duration_seconds_sum{http_request_method="GET",http_response_status_code="204",http_route="/noop",url_scheme="http"}`), time.Microsecond.Seconds())
+}
+
+func TestRegisterWorkerPool(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry})
+	e.GET("/metrics", prom.ExporterHandler())
+
+	var busy atomic.Int64
+	busy.Store(6)
+	prom.RegisterWorkerPool("sse", func() int { return int(busy.Load()) }, func() int { return 8 })
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(6), sampleValue(t, body, `http_server_worker_pool_active{worker_pool_name="sse"}`))
+	assert.Equal(t, float64(8), sampleValue(t, body, `http_server_worker_pool_capacity{worker_pool_name="sse"}`))
+	assert.Equal(t, 0.75, sampleValue(t, body, `http_server_worker_pool_utilization_ratio{worker_pool_name="sse"}`))
+
+	busy.Store(2)
+	body, _ = requestBody(e, "/metrics")
+	assert.Equal(t, float64(2), sampleValue(t, body, `http_server_worker_pool_active{worker_pool_name="sse"}`))
+	assert.Equal(t, 0.25, sampleValue(t, body, `http_server_worker_pool_utilization_ratio{worker_pool_name="sse"}`))
+}
+
+func TestEnableOpenMetrics(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		e := echo.New()
+		customRegistry := prometheus.NewRegistry()
+		prom := New(MiddlewareConfig{Registry: customRegistry, EnableOpenMetrics: enabled})
+		e.GET("/metrics", prom.ExporterHandler())
+
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Header.Set("Accept", "application/openmetrics-text")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		if enabled {
+			assert.True(t, strings.HasPrefix(rec.Header().Get(echo.HeaderContentType), "application/openmetrics-text"))
+			assert.True(t, strings.HasSuffix(rec.Body.String(), "# EOF\n"))
+		} else {
+			assert.True(t, strings.HasPrefix(rec.Header().Get(echo.HeaderContentType), "text/plain"))
+		}
+
+		// scrapers not asking for OpenMetrics keep getting the text format
+		req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		rec = httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.True(t, strings.HasPrefix(rec.Header().Get(echo.HeaderContentType), "text/plain"))
+	}
+}
+
+func TestDisableCompression(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		e := echo.New()
+		customRegistry := prometheus.NewRegistry()
+		prom := New(MiddlewareConfig{Registry: customRegistry, DisableCompression: disabled})
+		e.GET("/metrics", prom.ExporterHandler())
+
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Header.Set(echo.HeaderAcceptEncoding, "gzip")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		if disabled {
+			assert.Empty(t, rec.Header().Get(echo.HeaderContentEncoding))
+			assert.Contains(t, rec.Body.String(), "target_info")
+		} else {
+			assert.Equal(t, "gzip", rec.Header().Get(echo.HeaderContentEncoding))
+			gz, err := gzip.NewReader(rec.Body)
+			assert.NoError(t, err)
+			body, err := io.ReadAll(gz)
+			assert.NoError(t, err)
+			assert.Contains(t, string(body), "target_info")
+		}
+	}
+}
+
+// errorLog collects the messages passed to promhttp.Logger
+type errorLog struct {
+	messages []string
+}
+
+func (l *errorLog) Println(v ...interface{}) {
+	l.messages = append(l.messages, fmt.Sprint(v...))
+}
+
+func TestHandlerErrorHandling(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	log := &errorLog{}
+	prom := New(MiddlewareConfig{
+		Registerer: customRegistry,
+		Gatherer: prometheus.Gatherers{customRegistry, prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return nil, errors.New("collector is broken")
+		})},
+		HandlerErrorHandling: promhttp.ContinueOnError,
+		ErrorLog:             log,
+	})
+	e.GET("/metrics", prom.ExporterHandler())
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "target_info")
+	if assert.Len(t, log.messages, 1) {
+		assert.Contains(t, log.messages[0], "collector is broken")
+	}
+}
+
+func TestMetricsAuth(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:            customRegistry,
+		MetricsAuth:         &BasicAuth{Username: "prometheus", Password: "secret"},
+		EnableResetEndpoint: true,
+	})
+	prom.Setup(e)
+
+	scrape := func(username, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := scrape("prometheus", "secret")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "target_info")
+
+	rec = scrape("prometheus", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, `Basic realm="metrics"`, rec.Header().Get(echo.HeaderWWWAuthenticate))
+	assert.NotContains(t, rec.Body.String(), "target_info")
+
+	assert.Equal(t, http.StatusUnauthorized, scrape("", "").Code)
+
+	req := httptest.NewRequest(http.MethodPost, "/metrics/reset", nil)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestMetricsAuthorizer(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry: customRegistry,
+		MetricsAuthorizer: func(c echo.Context) bool {
+			return c.Request().Header.Get(echo.HeaderAuthorization) == "Bearer token"
+		},
+	})
+	e.GET("/metrics", prom.ExporterHandler())
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer token")
 	rec := httptest.NewRecorder()
 	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer other")
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Empty(t, rec.Header().Get(echo.HeaderWWWAuthenticate))
+}
+
+func TestDurationUnit(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry, DurationUnit: "ms"})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/slow", func(c echo.Context) error {
+		time.Sleep(30 * time.Millisecond)
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/slow"))
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotContains(t, body, "http_server_request_duration_seconds")
+	assert.Contains(t, body, `http_server_request_duration_milliseconds_bucket{http_request_method="GET",http_response_status_code="200",http_route="/slow",url_scheme="http",le="25"} 0`)
+	assert.Contains(t, body, `http_server_request_duration_milliseconds_bucket{http_request_method="GET",http_response_status_code="200",http_route="/slow",url_scheme="http",le="10000"} 1`)
+	assert.GreaterOrEqual(t, sampleValue(t, body, `http_server_request_duration_milliseconds_sum{http_request_method="GET",http_response_status_code="200",http_route="/slow",url_scheme="http"}`), float64(30))
+
+	_, err := NewWithError(MiddlewareConfig{Registry: prometheus.NewRegistry(), DurationUnit: "us"})
+	assert.ErrorContains(t, err, `invalid DurationUnit "us"`)
+
+	// the DurationBuckets in milliseconds are converted for the histograms recording seconds
+	e = echo.New()
+	prom = New(MiddlewareConfig{
+		Registry:        prometheus.NewRegistry(),
+		DurationUnit:    "ms",
+		DurationBuckets: []float64{5, 50, 500},
+		WithTTFB:        true,
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+	body, code = requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `http_server_request_duration_milliseconds_bucket{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http",le="500"} 1`)
+	assert.Contains(t, body, `http_server_request_time_to_first_byte_seconds_bucket{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http",le="0.5"} 1`)
+	assert.NotContains(t, body, `http_server_request_time_to_first_byte_seconds_bucket{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http",le="500"}`)
+}
+
+func TestBuckets(t *testing.T) {
+	assert.Equal(t, []float64{0.01, 0.02, 0.04, 0.08}, ExponentialBuckets(0.01, 2, 4))
+	assert.Equal(t, []float64{100, 150, 200}, LinearBuckets(100, 50, 3))
+	assert.Panics(t, func() { ExponentialBuckets(0, 2, 4) })
+	assert.Panics(t, func() { LinearBuckets(100, 50, 0) })
+
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:        customRegistry,
+		DurationBuckets: append(DefaultDurationBuckets[:len(DefaultDurationBuckets):len(DefaultDurationBuckets)], 30, 60),
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+	body, _ := requestBody(e, "/metrics")
+	assert.Contains(t, body, `http_server_request_duration_seconds_bucket{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http",le="60"} 1`)
+	assert.Len(t, DefaultDurationBuckets, 11)
+}
+
+func TestWithLongDurationHistogram(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:                  customRegistry,
+		WithLongDurationHistogram: true,
+		LongDurationThreshold:     20 * time.Millisecond,
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/slow", func(c echo.Context) error {
+		time.Sleep(30 * time.Millisecond)
+		return c.String(http.StatusOK, "OK")
+	})
+	e.GET("/fast", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/slow"))
+	assert.Equal(t, http.StatusOK, request(e, "/fast"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `http_server_request_duration_long_seconds_bucket{http_request_method="GET",http_response_status_code="200",http_route="/slow",url_scheme="http",le="0.5"} 1`)
+	assert.Contains(t, body, `http_server_request_duration_long_seconds_bucket{http_request_method="GET",http_response_status_code="200",http_route="/slow",url_scheme="http",le="300"} 1`)
+	assert.NotContains(t, body, `http_server_request_duration_long_seconds_count{http_request_method="GET",http_response_status_code="200",http_route="/fast"`)
+	// the main histogram records both
+	assert.Contains(t, body, `http_server_request_duration_seconds_count{http_request_method="GET",http_response_status_code="200",http_route="/fast",url_scheme="http"} 1`)
+}
+
+func TestViews(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry: customRegistry,
+		Views: []sdkmetric.View{
+			sdkmetric.NewView(
+				sdkmetric.Instrument{Name: "requests"},
+				sdkmetric.Stream{AttributeFilter: attribute.NewDenyKeysFilter(URLScheme)},
+			),
+		},
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/ping"} 1`)
+	// the instruments not matched by the view are untouched
+	assert.Contains(t, body, `http_server_request_duration_seconds_count{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http"} 1`)
+}
+
+func TestMaxRouteCardinality(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry:            customRegistry,
+		MaxRouteCardinality: 2,
+		RouteNormalizer: func(path string) string {
+			return path
+		},
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	assert.Equal(t, http.StatusNotFound, request(e, "/random-1"))
+	assert.Equal(t, http.StatusNotFound, request(e, "/random-2"))
+	assert.Equal(t, http.StatusNotFound, request(e, "/random-3"))
+	assert.Equal(t, http.StatusNotFound, request(e, "/random-4"))
+	assert.Equal(t, http.StatusNotFound, request(e, "/random-1"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(2), sampleValue(t, body, `requests_total{http_request_method="GET",http_response_status_code="404",http_route="/random-1",url_scheme="http"}`))
+	assert.Equal(t, float64(1), sampleValue(t, body, `requests_total{http_request_method="GET",http_response_status_code="404",http_route="/random-2",url_scheme="http"}`))
+	assert.Equal(t, float64(2), sampleValue(t, body, `requests_total{http_request_method="GET",http_response_status_code="404",http_route="__overflow__",url_scheme="http"}`))
+	assert.NotContains(t, body, `http_route="/random-3"`)
+}
+
+func TestNormalizeMethods(t *testing.T) {
+	normalize := false
+	for _, normalizeMethods := range []*bool{nil, &normalize} {
+		e := echo.New()
+		customRegistry := prometheus.NewRegistry()
+		prom := New(MiddlewareConfig{Registry: customRegistry, NormalizeMethods: normalizeMethods})
+		e.Use(prom.Middleware())
+		e.GET("/metrics", prom.ExporterHandler())
+		e.Any("/ping", func(c echo.Context) error {
+			return c.String(http.StatusOK, "OK")
+		})
+
+		// echo rejects the methods it does not know with a 405
+		req := httptest.NewRequest("FOO", "/ping", nil)
+		e.ServeHTTP(httptest.NewRecorder(), req)
+		req = httptest.NewRequest(http.MethodPatch, "/ping", nil)
+		e.ServeHTTP(httptest.NewRecorder(), req)
+
+		body, code := requestBody(e, "/metrics")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Contains(t, body, `requests_total{http_request_method="PATCH",http_response_status_code="200",http_route="/ping",url_scheme="http"} 1`)
+		if normalizeMethods == nil {
+			assert.Contains(t, body, `requests_total{http_request_method="_OTHER",http_response_status_code="405",http_route="/ping",url_scheme="http"} 1`)
+			assert.NotContains(t, body, `http_request_method="FOO"`)
+		} else {
+			assert.Contains(t, body, `requests_total{http_request_method="FOO",http_response_status_code="405",http_route="/ping",url_scheme="http"} 1`)
+		}
+	}
+}
+
+func TestTrustForwardedHeaders(t *testing.T) {
+	for _, trust := range []bool{false, true} {
+		e := echo.New()
+		customRegistry := prometheus.NewRegistry()
+		prom := New(MiddlewareConfig{Registry: customRegistry, TrustForwardedHeaders: trust, WithServerPort: true, EnableServerAddrPort: true})
+		e.Use(prom.Middleware())
+		e.GET("/metrics", prom.ExporterHandler())
+		e.GET("/ping", func(c echo.Context) error {
+			return c.String(http.StatusOK, "OK")
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+		req.Host = "10.0.0.1:8080"
+		req.Header.Set(echo.HeaderXForwardedProto, "https")
+		req.Header.Set("X-Forwarded-Host", "api.example.com, proxy.internal")
+		e.ServeHTTP(httptest.NewRecorder(), req)
+
+		body, code := requestBody(e, "/metrics")
+		assert.Equal(t, http.StatusOK, code)
+		if trust {
+			assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/ping",server_address="api.example.com",server_port="443",url_scheme="https"} 1`)
+		} else {
+			assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/ping",server_address="10.0.0.1",server_port="8080",url_scheme="https"} 1`)
+		}
+
+		// a spoofed scheme can not create series unless the headers are trusted
+		req = httptest.NewRequest(http.MethodGet, "/ping", nil)
+		req.Host = "10.0.0.1:8080"
+		req.Header.Set(echo.HeaderXForwardedProto, "spoofed")
+		e.ServeHTTP(httptest.NewRecorder(), req)
+
+		body, _ = requestBody(e, "/metrics")
+		if trust {
+			assert.Contains(t, body, `url_scheme="spoofed"`)
+		} else {
+			assert.NotContains(t, body, `url_scheme="spoofed"`)
+			assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/ping",server_address="10.0.0.1",server_port="8080",url_scheme="http"} 1`)
+		}
+	}
+}
+
+func TestWebSocketMode(t *testing.T) {
+	for _, mode := range []WebSocketMode{WebSocketRecordDuration, WebSocketSkipDuration, WebSocketCountConnections} {
+		e := echo.New()
+		customRegistry := prometheus.NewRegistry()
+		prom := New(MiddlewareConfig{Registry: customRegistry, WebSocketMode: mode})
+		e.Use(prom.Middleware())
+		e.GET("/metrics", prom.ExporterHandler())
+		e.GET("/ws", func(c echo.Context) error {
+			c.Response().Header().Set(echo.HeaderUpgrade, "websocket")
+			c.Response().Header().Set(echo.HeaderConnection, "Upgrade")
+			return c.NoContent(http.StatusSwitchingProtocols)
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		req.Header.Set(echo.HeaderUpgrade, "websocket")
+		req.Header.Set(echo.HeaderConnection, "Upgrade")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusSwitchingProtocols, rec.Code)
+
+		body, code := requestBody(e, "/metrics")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="101",http_route="/ws",url_scheme="http"} 1`)
+		durationCount := `http_server_request_duration_seconds_count{http_request_method="GET",http_response_status_code="101",http_route="/ws",url_scheme="http"} 1`
+		switch mode {
+		case WebSocketRecordDuration:
+			assert.Contains(t, body, durationCount)
+			assert.NotContains(t, body, "http_server_websocket_connections_total")
+		case WebSocketSkipDuration:
+			assert.NotContains(t, body, durationCount)
+			assert.NotContains(t, body, "http_server_websocket_connections_total")
+		case WebSocketCountConnections:
+			assert.NotContains(t, body, durationCount)
+			assert.Contains(t, body, `http_server_websocket_connections_total{http_route="/ws"} 1`)
+		}
+	}
+
+	// with a real connection hijacked like gorilla/websocket does
+	for _, mode := range []WebSocketMode{WebSocketRecordDuration, WebSocketSkipDuration, WebSocketCountConnections} {
+		e := echo.New()
+		customRegistry := prometheus.NewRegistry()
+		// the hijacking is detected without the size metrics as well
+		prom := New(MiddlewareConfig{Registry: customRegistry, WebSocketMode: mode, DisableSizeMetrics: true})
+		e.Use(prom.Middleware())
+		e.GET("/metrics", prom.ExporterHandler())
+		// like gorilla/websocket, the 101 response is written on the hijacked connection
+		e.GET("/ws", func(c echo.Context) error {
+			conn, rw, err := c.Response().Hijack()
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+			return rw.Flush()
+		})
+
+		server := httptest.NewServer(e)
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/ws", nil)
+		assert.NoError(t, err)
+		req.Header.Set(echo.HeaderUpgrade, "websocket")
+		req.Header.Set(echo.HeaderConnection, "Upgrade")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+		resp.Body.Close()
+		server.Close()
+
+		// the request is recorded once the handler returns, after the client got the 101
+		var body string
+		assert.Eventually(t, func() bool {
+			body, _ = requestBody(e, "/metrics")
+			return strings.Contains(body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/ws",url_scheme="http"} 1`)
+		}, 5*time.Second, 10*time.Millisecond)
+		durationCount := `http_server_request_duration_seconds_count{http_request_method="GET",http_response_status_code="200",http_route="/ws",url_scheme="http"} 1`
+		switch mode {
+		case WebSocketRecordDuration:
+			assert.Contains(t, body, durationCount)
+		case WebSocketSkipDuration:
+			assert.NotContains(t, body, durationCount)
+			assert.NotContains(t, body, "http_server_websocket_connections_total")
+		case WebSocketCountConnections:
+			assert.NotContains(t, body, durationCount)
+			assert.Contains(t, body, `http_server_websocket_connections_total{http_route="/ws"} 1`)
+		}
+	}
+}
+
+func TestWithErrorCounter(t *testing.T) {
+	for _, includeClientErrors := range []bool{false, true} {
+		e := echo.New()
+		customRegistry := prometheus.NewRegistry()
+		prom := New(MiddlewareConfig{
+			Registry:                        customRegistry,
+			WithErrorCounter:                true,
+			ErrorCounterIncludeClientErrors: includeClientErrors,
+		})
+		e.Use(prom.Middleware())
+		e.GET("/metrics", prom.ExporterHandler())
+		e.GET("/fail", func(c echo.Context) error {
+			return c.NoContent(http.StatusBadGateway)
+		})
+		e.GET("/fail-again", func(c echo.Context) error {
+			return echo.ErrInternalServerError
+		})
+		e.GET("/bad", func(c echo.Context) error {
+			return echo.ErrBadRequest
+		})
+
+		assert.Equal(t, http.StatusBadGateway, request(e, "/fail"))
+		assert.Equal(t, http.StatusBadGateway, request(e, "/fail"))
+		assert.Equal(t, http.StatusInternalServerError, request(e, "/fail-again"))
+		assert.Equal(t, http.StatusBadRequest, request(e, "/bad"))
+
+		body, code := requestBody(e, "/metrics")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Contains(t, body, `http_server_errors_total{http_request_method="GET",http_route="/fail"} 2`)
+		assert.Contains(t, body, `http_server_errors_total{http_request_method="GET",http_route="/fail-again"} 1`)
+		if includeClientErrors {
+			assert.Contains(t, body, `http_server_errors_total{http_request_method="GET",http_route="/bad"} 1`)
+		} else {
+			assert.NotContains(t, body, `http_server_errors_total{http_request_method="GET",http_route="/bad"}`)
+		}
+	}
+}
+
+func TestWithTTFB(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry, WithTTFB: true})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/stream", func(c echo.Context) error {
+		time.Sleep(10 * time.Millisecond)
+		c.Response().WriteHeader(http.StatusOK)
+		c.Response().Flush()
+		// slow body transfer after the first byte
+		time.Sleep(40 * time.Millisecond)
+		_, err := c.Response().Write([]byte("done"))
+		return err
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/stream"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	ttfb := sampleValue(t, body, `http_server_request_time_to_first_byte_seconds_sum{http_request_method="GET",http_response_status_code="200",http_route="/stream",url_scheme="http"}`)
+	assert.GreaterOrEqual(t, ttfb, 0.01)
+	assert.Less(t, ttfb, 0.05)
+	assert.Contains(t, body, `http_server_request_time_to_first_byte_seconds_count{http_request_method="GET",http_response_status_code="200",http_route="/stream",url_scheme="http"} 1`)
+}
+
+func TestHandlerNameFromContext(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry, HandlerNameFromContext: "metric_name"})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	listUsers := func(c echo.Context) error {
+		c.Set("metric_name", "list_users")
+		return c.String(http.StatusOK, "OK")
+	}
+	e.GET("/v1/users", listUsers)
+	e.GET("/v2/users", listUsers)
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/v1/users"))
+	assert.Equal(t, http.StatusOK, request(e, "/v2/users"))
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{handler="list_users",http_request_method="GET",http_response_status_code="200",http_route="/v1/users",url_scheme="http"} 1`)
+	assert.Contains(t, body, `requests_total{handler="list_users",http_request_method="GET",http_response_status_code="200",http_route="/v2/users",url_scheme="http"} 1`)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http"} 1`)
+}
+
+func TestURLLabelFromContext(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry, URLLabelFromContext: "url_label"})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/files/*", func(c echo.Context) error {
+		c.Set("url_label", "/files/"+strings.SplitN(c.Param("*"), "/", 2)[0])
+		return c.String(http.StatusOK, "OK")
+	})
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/files/images/logo.png"))
+	assert.Equal(t, http.StatusOK, request(e, "/files/images/icon.png"))
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/files/images",url_scheme="http"} 2`)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="unknown",url_scheme="http"} 1`)
+}
+
+func TestRequestCounterURLLabelMappingFunc(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry: customRegistry,
+		RequestCounterURLLabelMappingFunc: func(c echo.Context) string {
+			if c.Path() == "/internal/*" {
+				return ""
+			}
+			url := c.Request().URL.Path
+			for i, name := range c.ParamNames() {
+				url = strings.Replace(url, c.ParamValues()[i], ":"+name, 1)
+			}
+			return url
+		},
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/customer/:name", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+	e.GET("/internal/*", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/customer/alice"))
+	assert.Equal(t, http.StatusOK, request(e, "/customer/bob"))
+	assert.Equal(t, http.StatusOK, request(e, "/internal/debug"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/customer/:name",url_scheme="http"} 2`)
+	assert.Contains(t, body, `http_server_request_duration_seconds_count{http_request_method="GET",http_response_status_code="200",http_route="/customer/:name",url_scheme="http"} 2`)
+	assert.Contains(t, body, `http_server_response_body_size_bytes_count{http_request_method="GET",http_response_status_code="200",http_route="/customer/:name",url_scheme="http"} 2`)
+	// the empty label skips the request entirely
+	assert.NotContains(t, body, `http_route="/internal`)
+	assert.NotContains(t, body, `http_route=""`)
 
-	return rec.Body.String(), rec.Code
+	// URLLabelFromContext takes precedence, the mapping does not skip the request then
+	e = echo.New()
+	customRegistry = prometheus.NewRegistry()
+	prom = New(MiddlewareConfig{
+		Registry:            customRegistry,
+		URLLabelFromContext: "url_label",
+		RequestCounterURLLabelMappingFunc: func(c echo.Context) string {
+			return ""
+		},
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/internal/*", func(c echo.Context) error {
+		c.Set("url_label", "/internal")
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/internal/debug"))
+	body, code = requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/internal",url_scheme="http"} 1`)
 }
 
-func request(e *echo.Echo, path string) int {
-	_, code := requestBody(e, path)
-	return code
+func TestMetricNames(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{
+		Registry: customRegistry,
+		MetricNames: MetricNames{
+			RequestDuration: "api.latency",
+			Requests:        "api.requests",
+			ActiveRequests:  "api.inflight",
+		},
+	})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `api_requests_total{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http"} 1`)
+	assert.Contains(t, body, `api_latency_seconds_count{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http"} 1`)
+	assert.Contains(t, body, `api_inflight{`)
+	assert.Contains(t, body, `http_server_request_body_size_bytes_count{`)
+	assert.NotContains(t, body, "http_server_request_duration_seconds")
+	assert.NotContains(t, body, "\nrequests_total")
+
+	_, err := NewWithError(MiddlewareConfig{Registry: prometheus.NewRegistry(), MetricNames: MetricNames{Requests: " "}})
+	assert.ErrorContains(t, err, `invalid metric name " " in MetricNames`)
 }
 
-func unregisterDefaults(subsystem string) {
-	// this is extremely hacky way to unregister our middleware metrics that it registers to prometheus default registry
-	// Metrics/collector can be unregistered only by their instance but we do not have their instance, so we need to
-	// create similar collector to register it and get error back with that existing collector we actually want to
-	// unregister
-	p := prometheus.DefaultRegisterer
+func TestNamespaceSanitized(t *testing.T) {
+	assert.Equal(t, "", sanitizeNamespace(""))
+	assert.Equal(t, "myapp", sanitizeNamespace("myapp"))
+	assert.Equal(t, "_9app", sanitizeNamespace("9app"))
+	assert.Equal(t, "my_app_v2", sanitizeNamespace("my.app/v2"))
 
-	unRegisterCollector := func(opts prometheus.Opts) {
-		dummyDuplicate := prometheus.NewCounterVec(prometheus.CounterOpts(opts), []string{"http_request_method", "http_response_status_code", "http_route", "server_address", "url_scheme"})
-		err := p.Register(dummyDuplicate)
-		if err == nil {
-			return
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry, ServiceName: "9app"})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `_9app_requests_total{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http"} 1`)
+}
+
+func TestUnregister(t *testing.T) {
+	customRegistry := prometheus.NewRegistry()
+	first := New(MiddlewareConfig{Registry: customRegistry})
+	e := echo.New()
+	e.Use(first.Middleware())
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+
+	collector := first.collector
+	first.Unregister()
+	first.Unregister()
+
+	second := New(MiddlewareConfig{Registry: customRegistry})
+	// the registry can not drop the unchecked forwarder, the next instance takes it over
+	assert.Same(t, collector, second.collector)
+	first.Unregister()
+	assert.ErrorIs(t, first.Reload(MiddlewareConfig{Registry: customRegistry}), ErrAlreadyRegistered)
+	e = echo.New()
+	e.Use(second.Middleware())
+	e.GET("/metrics", second.ExporterHandler())
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http"} 2`)
+	assert.Equal(t, 1, strings.Count(body, "# TYPE requests_total counter"))
+}
+
+// sentinelCollector is registered to tell when a registry is garbage collected, the registry itself is
+// part of a reference cycle with the exporter collector where a finalizer is not guaranteed to run
+type sentinelCollector struct {
+	_ int
+}
+
+func (s *sentinelCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (s *sentinelCollector) Collect(chan<- prometheus.Metric) {}
+
+func TestRegistryReleased(t *testing.T) {
+	setGlobalProvider := false
+	released := make(chan struct{})
+	func() {
+		customRegistry := prometheus.NewRegistry()
+		sentinel := &sentinelCollector{}
+		runtime.SetFinalizer(sentinel, func(*sentinelCollector) { close(released) })
+		customRegistry.MustRegister(sentinel)
+		prom := New(MiddlewareConfig{Registry: customRegistry, SetGlobalProvider: &setGlobalProvider})
+		_, err := NewWithError(MiddlewareConfig{Registry: customRegistry, SetGlobalProvider: &setGlobalProvider})
+		assert.ErrorIs(t, err, ErrAlreadyRegistered)
+		assert.NoError(t, prom.provider.Shutdown(context.Background()))
+	}()
+
+	// nothing global keeps the registry of a dropped instance alive
+	assert.Eventually(t, func() bool {
+		runtime.GC()
+		select {
+		case <-released:
+			return true
+		default:
+			return false
 		}
-		// slog.Error("unregistering", "opts", opts, "err", err)
-		var arErr prometheus.AlreadyRegisteredError
-		if errors.As(err, &arErr) {
-			p.Unregister(arErr.ExistingCollector)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestNewTwiceOnDefaultRegistry(t *testing.T) {
+	first := New(MiddlewareConfig{})
+
+	_, err := NewWithError(MiddlewareConfig{})
+	assert.ErrorIs(t, err, ErrAlreadyRegistered)
+	assert.PanicsWithError(t, "metrics already registered; use a custom Registry or call Unregister", func() {
+		New(MiddlewareConfig{})
+	})
+
+	first.Unregister()
+	second, err := NewWithError(MiddlewareConfig{})
+	assert.NoError(t, err)
+	collector := second.collector
+	second.Unregister()
+
+	// repeated New/Unregister cycles keep a single collector in the registry
+	for range 10 {
+		next, err := NewWithError(MiddlewareConfig{})
+		assert.NoError(t, err)
+		assert.Same(t, collector, next.collector)
+		next.Unregister()
+	}
+}
+
+func TestConcurrencyHistogram(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry, WithConcurrencyHistogram: true})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	started := make(chan struct{})
+	release := make(chan struct{})
+	e.GET("/slow", func(c echo.Context) error {
+		started <- struct{}{}
+		<-release
+		return c.String(http.StatusOK, "OK")
+	})
+
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request(e, "/slow")
+		}()
+		<-started
+	}
+	close(release)
+	wg.Wait()
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `http_server_concurrency_bucket{le="1"} 1`)
+	assert.Contains(t, body, `http_server_concurrency_bucket{le="2"} 2`)
+	assert.Contains(t, body, `http_server_concurrency_bucket{le="5"} 3`)
+	assert.Contains(t, body, `http_server_concurrency_count 3`)
+	assert.Contains(t, body, `http_server_concurrency_sum 6`)
+}
+
+func TestSampleRate(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry, SampleRate: 0.5})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	for range 1000 {
+		assert.Equal(t, http.StatusOK, request(e, "/ping"))
+	}
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http"} 1000`)
+	sampled := sampleValue(t, body, `http_server_request_duration_seconds_count{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http"}`)
+	assert.InDelta(t, 500, sampled, 100)
+	assert.Equal(t, sampled, sampleValue(t, body, `http_server_response_body_size_bytes_count{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http"}`))
+
+	_, err := NewWithError(MiddlewareConfig{Registry: prometheus.NewRegistry(), SampleRate: 1.5})
+	assert.ErrorContains(t, err, "invalid SampleRate 1.5")
+}
+
+func TestRequestSizeChunkedBody(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.POST("/upload", func(c echo.Context) error {
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return err
 		}
+		return c.String(http.StatusOK, string(body))
+	})
+
+	// a reader of unknown length is sent chunked, ContentLength is -1
+	req := httptest.NewRequest(http.MethodPost, "/upload", io.MultiReader(strings.NewReader("hello world")))
+	assert.Equal(t, int64(-1), req.ContentLength)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, "hello world", rec.Body.String())
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	// path, method, proto and host, no headers, plus the 11 body bytes
+	assert.Contains(t, body, `http_server_request_body_size_bytes_sum{http_request_method="POST",http_response_status_code="200",http_route="/upload",url_scheme="http"} 41`)
+}
+
+func TestCatchAllRouteLabel(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry, UnmatchedRouteLabel: "unmatched"})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	v1 := e.Group("/api/v1")
+	v1.GET("/users/:id", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+	v1.RouteNotFound("/*", func(c echo.Context) error {
+		return c.NoContent(http.StatusNotFound)
+	})
+	e.Any("/*", func(c echo.Context) error {
+		return c.String(http.StatusOK, "spa")
+	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/api/v1/users/42"))
+	assert.Equal(t, http.StatusNotFound, request(e, "/api/v1/nope"))
+	assert.Equal(t, http.StatusOK, request(e, "/app/settings"))
+	assert.Equal(t, http.StatusOK, request(e, "/"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/api/v1/users/:id",url_scheme="http"} 1`)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="404",http_route="/api/v1/*",url_scheme="http"} 1`)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/*",url_scheme="http"} 2`)
+	assert.NotContains(t, body, `http_route="unmatched"`)
+}
+
+func TestMetricsEndpointRecorded(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry, IncludeMetricsEndpoint: true})
+	prom.Setup(e)
+
+	_, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/metrics",url_scheme="http"} 1`)
+	assert.Contains(t, body, `http_server_response_body_size_bytes_count{http_request_method="GET",http_response_status_code="200",http_route="/metrics",url_scheme="http"} 1`)
+
+	// the scrapes are left out by default
+	e = echo.New()
+	prom = New(MiddlewareConfig{Registry: prometheus.NewRegistry()})
+	prom.Setup(e)
+	requestBody(e, "/metrics")
+	body, _ = requestBody(e, "/metrics")
+	assert.NotContains(t, body, `http_route="/metrics"`)
+}
+
+func TestReset(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		t.Run(fmt.Sprintf("RecordAsync=%v", async), func(t *testing.T) {
+			e := echo.New()
+			customRegistry := prometheus.NewRegistry()
+			prom := New(MiddlewareConfig{Registry: customRegistry, RecordAsync: async})
+			e.Use(prom.Middleware())
+			e.GET("/ping", func(c echo.Context) error {
+				return c.String(http.StatusOK, "OK")
+			})
+			series := `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http"}`
+			// requests waits for the value of the series, the async recordings land a bit later
+			requests := func(expected float64) {
+				assert.Eventually(t, func() bool {
+					snapshot, err := prom.Snapshot()
+					return err == nil && snapshot[series] == expected
+				}, 5*time.Second, 10*time.Millisecond)
+			}
+
+			assert.Equal(t, http.StatusOK, request(e, "/ping"))
+			assert.Equal(t, http.StatusOK, request(e, "/ping"))
+			requests(2)
+
+			before := runtime.NumGoroutine()
+			assert.NoError(t, prom.Reset())
+			snapshot, err := prom.Snapshot()
+			assert.NoError(t, err)
+			assert.NotContains(t, snapshot, series)
+			// the worker of the replaced instance is stopped
+			assertGoroutinesAtMost(t, before)
+
+			assert.Equal(t, http.StatusOK, request(e, "/ping"))
+			requests(1)
+		})
 	}
+}
+
+func TestResetRecordsNotFound(t *testing.T) {
+	e := echo.New()
+	prom := New(MiddlewareConfig{Registry: prometheus.NewRegistry()})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+
+	// the default url label mapping comes back with the config, it must not skip the unmatched requests
+	assert.NoError(t, prom.Reset())
+	assert.Equal(t, http.StatusNotFound, request(e, "/missing"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `requests_total{http_request_method="GET",http_response_status_code="404"`)
+}
 
-	unRegisterCollector(prometheus.Opts{
-		Subsystem: subsystem,
-		Name:      "requests_total",
-		Help:      "How many HTTP requests processed, partitioned by status code and HTTP method.",
+func TestResetWithReader(t *testing.T) {
+	e := echo.New()
+	reader := sdkmetric.NewManualReader()
+	prom := New(MiddlewareConfig{Registry: prometheus.NewRegistry(), Reader: reader})
+	e.Use(prom.Middleware())
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
+	})
+
+	// the reader can not move to a new MeterProvider, it must keep working with the current one
+	assert.ErrorIs(t, prom.Reset(), ErrReaderInUse)
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+	var rm metricdata.ResourceMetrics
+	assert.NoError(t, reader.Collect(context.Background(), &rm))
+	assert.NotEmpty(t, rm.ScopeMetrics)
+
+	next := sdkmetric.NewManualReader()
+	config := prom.Config()
+	config.Reader = next
+	assert.NoError(t, prom.Reload(config))
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+	rm = metricdata.ResourceMetrics{}
+	assert.NoError(t, next.Collect(context.Background(), &rm))
+	assert.NotEmpty(t, rm.ScopeMetrics)
+}
+
+func TestTemporality(t *testing.T) {
+	e := echo.New()
+	reader := sdkmetric.NewManualReader(sdkmetric.WithTemporalitySelector(TemporalityDelta.TemporalitySelector()))
+	prom := New(MiddlewareConfig{Registry: prometheus.NewRegistry(), Reader: reader, Temporality: TemporalityDelta})
+	e.Use(prom.Middleware())
+	e.GET("/test", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
 	})
-	unRegisterCollector(prometheus.Opts{
-		Subsystem: subsystem,
-		Name:      "http_server_active_requests",
-		Help:      "Number of active HTTP server requests.",
+
+	// requests returns the sum of the requests counter and its temporality
+	requests := func() (int64, metricdata.Temporality) {
+		var rm metricdata.ResourceMetrics
+		assert.NoError(t, reader.Collect(context.Background(), &rm))
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				if sum, ok := m.Data.(metricdata.Sum[int64]); ok && m.Name == MetricRequests {
+					var total int64
+					for _, dp := range sum.DataPoints {
+						total += dp.Value
+					}
+					return total, sum.Temporality
+				}
+			}
+		}
+		return 0, metricdata.DeltaTemporality
+	}
+
+	assert.Equal(t, http.StatusOK, request(e, "/test"))
+	assert.Equal(t, http.StatusOK, request(e, "/test"))
+	total, temporality := requests()
+	assert.Equal(t, int64(2), total)
+	assert.Equal(t, metricdata.DeltaTemporality, temporality)
+
+	assert.Equal(t, http.StatusOK, request(e, "/test"))
+	total, _ = requests()
+	assert.Equal(t, int64(1), total, "delta sums restart at each collection")
+
+	_, err := NewWithError(MiddlewareConfig{Registry: prometheus.NewRegistry(), Temporality: TemporalityDelta})
+	assert.ErrorContains(t, err, "delta temporality is not supported by the prometheus exporter")
+	assert.Equal(t, metricdata.CumulativeTemporality, TemporalityCumulative.TemporalitySelector()(sdkmetric.InstrumentKindCounter))
+	assert.Equal(t, metricdata.CumulativeTemporality, TemporalityDelta.TemporalitySelector()(sdkmetric.InstrumentKindUpDownCounter))
+}
+
+func TestReloadStopsRecordWorker(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry, RecordAsync: true})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
 	})
-	unRegisterCollector(prometheus.Opts{
-		Subsystem: subsystem,
-		Name:      "http_server_request_duration_seconds",
-		Help:      "Duration of HTTP server requests in seconds.",
+
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+	before := runtime.NumGoroutine()
+	for range 20 {
+		assert.NoError(t, prom.Reload(prom.Config()))
+	}
+	// each Reload starts a worker for the new instance and stops the one of the old instance
+	assertGoroutinesAtMost(t, before)
+
+	// a request which got the old instance before the swap is dropped instead of panicking on the closed buffer
+	old := prom.active()
+	assert.NoError(t, prom.Reload(prom.Config()))
+	assert.NotPanics(t, func() {
+		old.recordAsync(context.Background(), func(context.Context) {})
 	})
-	unRegisterCollector(prometheus.Opts{
-		Subsystem: subsystem,
-		Name:      "http_server_response_body_size_bytes",
-		Help:      "Size of HTTP server response bodies.",
+
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+	assert.Eventually(t, func() bool {
+		body, _ := requestBody(e, "/metrics")
+		return strings.Contains(body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http"} 1`)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestMeter(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry})
+	e.GET("/metrics", prom.ExporterHandler())
+
+	counter, err := prom.Meter().Int64Counter("orders", metric.WithDescription("Number of orders."))
+	assert.NoError(t, err)
+	counter.Add(context.Background(), 3)
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "orders_total 3")
+}
+
+func TestBodyLimitRejected(t *testing.T) {
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry})
+	e.Use(prom.Middleware())
+	e.Use(middleware.BodyLimit("8B"))
+	e.GET("/metrics", prom.ExporterHandler())
+	e.POST("/upload", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
 	})
-	unRegisterCollector(prometheus.Opts{
-		Subsystem: subsystem,
-		Name:      "http_server_request_body_size_bytes",
-		Help:      "Size of HTTP server request bodies.",
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("this body is too large"))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `http_server_request_duration_seconds_count{http_request_method="POST",http_response_status_code="413",http_route="/upload",url_scheme="http"} 1`)
+	assert.Contains(t, body, `http_server_body_limit_rejected_total{http_route="/upload"} 1`)
+}
+
+func TestInstrumentsUseOwnProvider(t *testing.T) {
+	// a provider installed before New must not capture the middleware instruments
+	New(MiddlewareConfig{Registry: prometheus.NewRegistry()})
+
+	e := echo.New()
+	customRegistry := prometheus.NewRegistry()
+	prom := New(MiddlewareConfig{Registry: customRegistry})
+	e.Use(prom.Middleware())
+	e.GET("/metrics", prom.ExporterHandler())
+	e.GET("/ping", func(c echo.Context) error {
+		return c.String(http.StatusOK, "OK")
 	})
+
+	assert.Equal(t, http.StatusOK, request(e, "/ping"))
+
+	body, code := requestBody(e, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(1), sampleValue(t, body, `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http"}`))
 }
 
-// WriteGatheredMetrics gathers collected metrics and writes them to given writer
-func WriteGatheredMetrics(writer io.Writer, gatherer prometheus.Gatherer) error {
-	metricFamilies, err := gatherer.Gather()
-	if err != nil {
-		return err
+func TestConfigDefaults(t *testing.T) {
+	prom := New(MiddlewareConfig{Registry: prometheus.NewRegistry()})
+
+	config := prom.Config()
+	assert.Equal(t, "/metrics", config.MetricsPath)
+	assert.Equal(t, reflect.ValueOf(middleware.DefaultSkipper).Pointer(), reflect.ValueOf(config.Skipper).Pointer())
+	assert.NotNil(t, config.RequestCounterURLLabelMappingFunc)
+	assert.NotNil(t, config.RequestCounterHostLabelMappingFunc)
+	assert.NotNil(t, config.Registerer)
+	assert.NotNil(t, config.Gatherer)
+}
+
+func TestSetGlobalProviderDisabled(t *testing.T) {
+	global := sdkmetric.NewMeterProvider()
+	otel.SetMeterProvider(global)
+
+	setGlobalProvider := false
+	newApp := func() *echo.Echo {
+		e := echo.New()
+		prom := New(MiddlewareConfig{Registry: prometheus.NewRegistry(), SetGlobalProvider: &setGlobalProvider})
+		e.Use(prom.Middleware())
+		e.GET("/metrics", prom.ExporterHandler())
+		e.GET("/ping", func(c echo.Context) error {
+			return c.String(http.StatusOK, "OK")
+		})
+		return e
 	}
-	for _, mf := range metricFamilies {
-		if _, err := expfmt.MetricFamilyToText(writer, mf); err != nil {
-			return err
+	e1 := newApp()
+	e2 := newApp()
+	assert.Same(t, global, otel.GetMeterProvider())
+
+	assert.Equal(t, http.StatusOK, request(e1, "/ping"))
+	assert.Equal(t, http.StatusOK, request(e1, "/ping"))
+	assert.Equal(t, http.StatusOK, request(e2, "/ping"))
+
+	series := `requests_total{http_request_method="GET",http_response_status_code="200",http_route="/ping",url_scheme="http"}`
+	body, _ := requestBody(e1, "/metrics")
+	assert.Equal(t, float64(2), sampleValue(t, body, series))
+	body, _ = requestBody(e2, "/metrics")
+	assert.Equal(t, float64(1), sampleValue(t, body, series))
+}
+
+func BenchmarkMiddleware_ActiveRequests(b *testing.B) {
+	for _, noAttrs := range []bool{false, true} {
+		b.Run(fmt.Sprintf("ActiveRequestsNoAttributes=%v", noAttrs), func(b *testing.B) {
+			e := echo.New()
+			prom := New(MiddlewareConfig{
+				Registry:                   prometheus.NewRegistry(),
+				ActiveRequestsNoAttributes: noAttrs,
+			})
+			e.Use(prom.Middleware())
+			e.GET("/test", func(c echo.Context) error {
+				return c.NoContent(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/test", nil)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				e.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		})
+	}
+}
+
+func BenchmarkMiddleware_RecordAsync(b *testing.B) {
+	for _, async := range []bool{false, true} {
+		b.Run(fmt.Sprintf("RecordAsync=%v", async), func(b *testing.B) {
+			e := echo.New()
+			prom := New(MiddlewareConfig{
+				Registry:    prometheus.NewRegistry(),
+				RecordAsync: async,
+			})
+			e.Use(prom.Middleware())
+			e.GET("/test", func(c echo.Context) error {
+				return c.NoContent(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/test", nil)
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					e.ServeHTTP(httptest.NewRecorder(), req)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkMiddleware_Attributes(b *testing.B) {
+	for _, tc := range []struct {
+		name   string
+		config MiddlewareConfig
+	}{
+		{"Default", MiddlewareConfig{}},
+		{"RequestsAttributes", MiddlewareConfig{WithStatusClass: true, WithTrailersAttribute: true, WithBotAttribute: true}},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			e := echo.New()
+			tc.config.Registry = prometheus.NewRegistry()
+			prom := New(tc.config)
+			e.Use(prom.Middleware())
+			e.GET("/test", func(c echo.Context) error {
+				return c.NoContent(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/test", nil)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				e.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		})
+	}
+}
+
+func BenchmarkComputeApproximateRequestSize(b *testing.B) {
+	req := httptest.NewRequest(http.MethodGet, "/test?foo=bar", nil)
+	for i := range 30 {
+		req.Header.Add(fmt.Sprintf("X-Header-%d", i), strings.Repeat("v", 32))
+	}
+	req.Header.Add("Accept", "text/html")
+	req.Header.Add("Accept", "application/json")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		computeApproximateRequestSize(req)
+	}
+}
+
+func requestBody(e *echo.Echo, path string) (string, int) {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	return rec.Body.String(), rec.Code
+}
+
+func request(e *echo.Echo, path string) int {
+	_, code := requestBody(e, path)
+	return code
+}
+
+// assertGoroutinesAtMost waits for the number of goroutines to drop to n, polled by hand
+// as assert.Eventually runs goroutines of its own
+func assertGoroutinesAtMost(t *testing.T, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); runtime.NumGoroutine() > n && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), n)
+}
+
+// sampleValue returns the value of the series from the text exposition format body
+func sampleValue(t *testing.T, body, series string) float64 {
+	t.Helper()
+	for _, line := range strings.Split(body, "\n") {
+		if v, ok := strings.CutPrefix(line, series+" "); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			assert.NoError(t, err)
+			return f
 		}
 	}
-	return nil
+	t.Fatalf("series %s not found", series)
+	return 0
 }
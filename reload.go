@@ -0,0 +1,190 @@
+package echootelmetrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	realprometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrAlreadyRegistered is returned by NewWithError when another instance exports to the same Registerer,
+// its exporter collector would collide with the existing one on every scrape.
+var ErrAlreadyRegistered = errors.New("metrics already registered; use a custom Registry or call Unregister")
+
+// ErrReaderInUse is returned by Reload when the config has the custom Reader of the MeterProvider being replaced,
+// the SDK refuses to register it with the new one and shutting down the old one would shut it down.
+var ErrReaderInUse = errors.New("metrics reader already in use; Reload needs a new Reader")
+
+// collectorMarkerDesc is described by collectorMarker, it never has any metric
+var collectorMarkerDesc = realprometheus.NewDesc(
+	"echo_otel_metrics_exporter_registered",
+	"Marks the Registerer the exporter collector of the echo otel metrics middleware is registered with.",
+	nil, nil,
+)
+
+// collectorMarker is registered next to the unchecked exporter collector. Being a checked collector, a second
+// registration with the same Registerer fails with the first marker, which leads to the registered forwarder
+// without a global reference to the Registerer: the registry keeps both until it is dropped.
+type collectorMarker struct {
+	forwarder *reloadableCollector
+}
+
+// Describe implements prometheus.Collector
+func (m *collectorMarker) Describe(ch chan<- *realprometheus.Desc) {
+	ch <- collectorMarkerDesc
+}
+
+// Collect implements prometheus.Collector, there is nothing to collect
+func (m *collectorMarker) Collect(chan<- realprometheus.Metric) {}
+
+// registerCollector registers a new exporter collector with registerer, unless another one is registered.
+// The collector left behind by Metrics.Unregister is taken over instead, the registry can not drop it.
+func registerCollector(registerer realprometheus.Registerer) (*reloadableCollector, error) {
+	marker := &collectorMarker{forwarder: &reloadableCollector{registerer: registerer}}
+	if err := registerer.Register(marker); err != nil {
+		var are realprometheus.AlreadyRegisteredError
+		if !errors.As(err, &are) {
+			return nil, fmt.Errorf("failed to register the exporter collector: %w", err)
+		}
+		if existing, ok := are.ExistingCollector.(*collectorMarker); ok && existing.forwarder.takeOver() {
+			return existing.forwarder, nil
+		}
+		return nil, ErrAlreadyRegistered
+	}
+	if err := registerer.Register(marker.forwarder); err != nil {
+		registerer.Unregister(marker)
+		return nil, fmt.Errorf("failed to register the exporter collector: %w", err)
+	}
+	return marker.forwarder, nil
+}
+
+// reloadableCollector is registered once with the MiddlewareConfig.Registerer and forwards to the collector
+// of the current otel exporter. The exporter collector is unchecked (it describes no metrics), so the registry
+// can not unregister it, instead Reload hands the collector of the new exporter over to the same forwarder.
+// It is the Registerer the exporter registers its collector with.
+type reloadableCollector struct {
+	registerer realprometheus.Registerer
+	current    atomic.Pointer[realprometheus.Collector]
+	// mu serializes unregister and takeOver
+	mu sync.Mutex
+	// unregistered is set by Metrics.Unregister, a registry keeps unchecked collectors until it is dropped,
+	// so the forwarder stays silent until registerCollector hands it to the next instance
+	unregistered atomic.Bool
+}
+
+// Register implements prometheus.Registerer, it replaces the forwarded collector
+func (r *reloadableCollector) Register(c realprometheus.Collector) error {
+	r.current.Store(&c)
+	return nil
+}
+
+// MustRegister implements prometheus.Registerer
+func (r *reloadableCollector) MustRegister(cs ...realprometheus.Collector) {
+	for _, c := range cs {
+		_ = r.Register(c)
+	}
+}
+
+// Unregister implements prometheus.Registerer
+func (r *reloadableCollector) Unregister(c realprometheus.Collector) bool {
+	current := r.current.Load()
+	return current != nil && *current == c && r.current.CompareAndSwap(current, nil)
+}
+
+// unregister stops forwarding and releases the forwarder for the next exporter collector on the Registerer
+func (r *reloadableCollector) unregister() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.unregistered.Swap(true) {
+		r.current.Store(nil)
+	}
+}
+
+// takeOver reuses the forwarder released by unregister, it reports false while it is in use
+func (r *reloadableCollector) takeOver() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.unregistered.CompareAndSwap(true, false)
+}
+
+// Describe implements prometheus.Collector, it describes nothing like the otel exporter collector
+func (r *reloadableCollector) Describe(chan<- *realprometheus.Desc) {}
+
+// Collect implements prometheus.Collector
+func (r *reloadableCollector) Collect(ch chan<- realprometheus.Metric) {
+	if r.unregistered.Load() {
+		return
+	}
+	if current := r.current.Load(); current != nil {
+		(*current).Collect(ch)
+	}
+}
+
+// Reload rebuilds the instruments and the exporter from config and atomically swaps them in, e.g. on a
+// config hot reload, instead of creating a new middleware whose exporter would collide with the old one
+// on the same Registerer. The middleware and handlers returned before keep working with the new config,
+// requests already in flight are recorded by the old instruments. The recorded values restart from zero.
+//
+// With the same Registerer the new exporter replaces the old one in place, otherwise the old one stops
+// reporting. A handler returned by ExporterHandler before keeps its scrape options (Gatherer, MaxScrapeBytes...).
+func (p *Metrics) Reload(config MiddlewareConfig) error {
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+
+	old := p.active()
+	if config.Reader != nil && config.Reader == old.Reader {
+		return ErrReaderInUse
+	}
+	var previous *realprometheus.Collector
+	if old.collector != nil {
+		previous = old.collector.current.Load()
+	}
+	next, err := newMetrics(config, old)
+	if err != nil {
+		if old.collector != nil {
+			old.collector.current.Store(previous)
+		}
+		return err
+	}
+	next.notReady.Store(old.notReady.Load())
+	if old.collector != nil && old.collector != next.collector {
+		old.collector.unregister()
+	}
+	p.reloaded.Store(next)
+	// the requests in flight may still hold old, they find its buffer closed
+	old.stopRecordWorker()
+
+	if err := old.provider.Shutdown(context.Background()); err != nil {
+		return fmt.Errorf("failed to shut down the previous meter provider: %w", err)
+	}
+	return nil
+}
+
+// Unregister stops exporting the metrics of this instance to the MiddlewareConfig.Registerer, e.g. between
+// tests using the default registry, so another New can use it again. The exporter collector is unchecked,
+// the registry can not remove it: it stays registered but silent, and the next New on the same Registerer
+// forwards to its own exporter through it. The middleware keeps working, a later Reload of this instance
+// fails with ErrAlreadyRegistered if another instance took the Registerer over meanwhile.
+func (p *Metrics) Unregister() {
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+
+	active := p.active()
+	if active.collector != nil {
+		active.collector.unregister()
+		active.collector = nil
+	}
+}
+
+// active returns the instance built by the last Reload, or p itself
+func (p *Metrics) active() *Metrics {
+	if reloaded := p.reloaded.Load(); reloaded != nil {
+		return reloaded
+	}
+	return p
+}
@@ -0,0 +1,17 @@
+package echootelmetrics
+
+import "io"
+
+// countingReadCloser wraps a request body of unknown length (chunked) to count the bytes the handler read,
+// they are added to the approximate request size which can only take ContentLength from the headers.
+type countingReadCloser struct {
+	io.ReadCloser
+	read int64
+}
+
+// Read implements io.Reader
+func (r *countingReadCloser) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.read += int64(n)
+	return n, err
+}
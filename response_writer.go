@@ -0,0 +1,64 @@
+package echootelmetrics
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"time"
+)
+
+// countingResponseWriter wraps the echo.Response writer to count the bytes written around echo.Response,
+// e.g. by handlers streaming through c.Response().Writer, to tell whether the connection got hijacked
+// to keep the first write error and, with trackFirstByte, the time of the first byte.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	written  int64
+	hijacked bool
+	writeErr error
+
+	trackFirstByte bool
+	firstByte      time.Time
+}
+
+// WriteHeader implements http.ResponseWriter
+func (w *countingResponseWriter) WriteHeader(code int) {
+	w.markFirstByte()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements http.ResponseWriter
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	w.markFirstByte()
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	if err != nil && w.writeErr == nil {
+		w.writeErr = err
+	}
+	return n, err
+}
+
+// markFirstByte records the time the response headers or body started to be written
+func (w *countingResponseWriter) markFirstByte() {
+	if w.trackFirstByte && w.firstByte.IsZero() {
+		w.firstByte = time.Now()
+	}
+}
+
+// Flush implements http.Flusher
+func (w *countingResponseWriter) Flush() {
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack implements http.Hijacker
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// Unwrap returns the wrapped http.ResponseWriter for http.ResponseController
+func (w *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
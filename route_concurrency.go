@@ -0,0 +1,63 @@
+package echootelmetrics
+
+import (
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// routeConcurrencyLimit is the pair of funcs passed to RegisterRouteConcurrency
+type routeConcurrencyLimit struct {
+	current, max func() int64
+	attrs        attribute.Set
+}
+
+// routeConcurrencyLimits holds the routes registered with RegisterRouteConcurrency,
+// it is shared by the instances built by Reload.
+type routeConcurrencyLimits struct {
+	mu     sync.RWMutex
+	routes map[string]routeConcurrencyLimit
+}
+
+// RegisterRouteConcurrency reports the utilization of the concurrency limit (e.g. a semaphore) of route as
+// current()/max() in the `http.server.route.concurrency.utilization` gauge, labeled with http.route.
+// Both funcs are called on every collection and must be safe for concurrent use.
+//
+// Only the registered routes are reported, which keeps the cardinality bounded. Registering a route again
+// replaces its funcs. The route is not reported while max() returns 0 or less.
+func (p *Metrics) RegisterRouteConcurrency(route string, current, max func() int64) {
+	limits := p.active().routeConcurrency
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+	if limits.routes == nil {
+		limits.routes = make(map[string]routeConcurrencyLimit)
+	}
+	limits.routes[route] = routeConcurrencyLimit{
+		current: current,
+		max:     max,
+		attrs:   attribute.NewSet(HttpRoute.String(route)),
+	}
+}
+
+// registerRouteConcurrency installs the gauge observing the routes registered with RegisterRouteConcurrency
+func (p *Metrics) registerRouteConcurrency(meter metric.Meter) error {
+	_, err := meter.Float64ObservableGauge(
+		MetricHTTPServerRouteConcurrencyUtilization,
+		metric.WithUnit("1"),
+		metric.WithDescription("Utilization of the concurrency limit of HTTP server routes, from 0 to 1."),
+		metric.WithFloat64Callback(func(ctx context.Context, o metric.Float64Observer) error {
+			limits := p.routeConcurrency
+			limits.mu.RLock()
+			defer limits.mu.RUnlock()
+			for _, limit := range limits.routes {
+				if max := limit.max(); max > 0 {
+					o.Observe(float64(limit.current())/float64(max), metric.WithAttributeSet(limit.attrs))
+				}
+			}
+			return nil
+		}),
+	)
+	return err
+}
@@ -7,4 +7,108 @@ go test -v -run=TestDefaultRegistryMetrics
 go test -v -run=TestPrometheus_Buckets
 go test -v -run=TestMiddlewareConfig_Skipper
 go test -v -run=TestMetricsForErrors
-
+go test -v -run=TestActiveRequestsNoAttributes
+go test -v -run=TestWithTrailersAttribute
+go test -v -run=TestMetricPrefix
+go test -v -run=TestWithRequestURLAndHeaderSize
+go test -v -run=TestWithSerializerAttribute
+go test -v -run=TestRecordAsyncDropsWhenBufferFull
+go test -v -run=TestAttributeScrubber
+go test -v -run=TestLogicalErrorContextKey
+go test -v -run=TestPreflightAndConnectRouteLabel
+go test -v -run=TestCustomReader
+go test -v -run=TestWithConfigInfo
+go test -v -run=TestNewWithError
+go test -v -run=TestExportFilter
+go test -v -run=TestEndpointType
+go test -v -run=TestCustomBuckets
+go test -v -run=TestMetricsErrorAsJSON
+go test -v -run=TestErrorTypeForGoErrors
+go test -v -run=TestWithSetCookieCount
+go test -v -run=TestMetricsForPanics
+go test -v -run=TestWithServerPort
+go test -v -run=TestRouteTemplateResolver
+go test -v -run=TestTrimmedDurationThreshold
+go test -v -run=TestWithProtocolVersion
+go test -v -run=TestPreMiddleware
+go test -v -run=TestDisabledAttributes
+go test -v -run=TestMaxScrapeBytes
+go test -v -run=TestAdditionalAttributes
+go test -v -run=TestWithStatusClass
+go test -v -run=TestStatusClass
+go test -v -run=TestSetReady
+go test -v -run=TestNotFoundPathSegments
+go test -v -run=TestMeter
+go test -v -run=TestBodyLimitRejected
+go test -v -run=TestInstrumentsUseOwnProvider
+go test -v -run=TestConfigDefaults
+go test -v -run=TestSetGlobalProviderDisabled
+go test -v -run=TestUnmatchedRouteLabel
+go test -v -run=TestRouteNormalizer
+go test -v -run=TestSkipRouteMetrics
+go test -v -run=TestCacheResultHeader
+go test -v -run=TestDisableSizeMetrics
+go test -v -run=TestIgnorePaths
+go test -v -run=TestCounterSampleRoutes
+go test -v -run=TestGraphitePush
+go test -v -run=TestRequestSizeFunc
+go test -v -run=TestClientCertAttribute
+go test -v -run=TestResponseSizeHijackedAndStreamed
+go test -v -run=TestBuildInfo
+go test -v -run=TestReload
+go test -v -run=TestBotAttribute
+go test -v -run=TestRuntimeMetrics
+go test -v -run=TestSetup
+go test -v -run=TestResetEndpoint
+go test -v -run=TestBindDurationContextKey
+go test -v -run=TestSetupListenAddress
+go test -v -run=TestExemplars
+go test -v -run=TestPromoteInstanceLabel
+go test -v -run=TestNameSanitizer
+go test -v -run=TestTraceSampledAttribute
+go test -v -run=TestWriteTimeout
+go test -v -run=TestResourceAttributes
+go test -v -run=TestRegisterRouteConcurrency
+go test -v -run=TestWithoutUnits
+go test -v -run=TestScopeName
+go test -v -run=TestWithoutCounterSuffixes
+go test -v -run=TestUncompressedCompressible
+go test -v -run=TestGatherer
+go test -v -run=TestWriteGatheredMetricsOpenMetrics
+go test -v -run=TestMinRecordedDuration
+go test -v -run=TestRegisterWorkerPool
+go test -v -run=TestEnableOpenMetrics
+go test -v -run=TestDisableCompression
+go test -v -run=TestHandlerErrorHandling
+go test -v -run=TestMetricsAuth
+go test -v -run=TestWithActiveRequestRoute
+go test -v -run=TestActiveRequestsBalancedOnPanic
+go test -v -run=TestDurationUnit
+go test -v -run=TestBuckets
+go test -v -run=TestWithLongDurationHistogram
+go test -v -run=TestViews
+go test -v -run=TestMaxRouteCardinality
+go test -v -run=TestNormalizeMethods
+go test -v -run=TestTrustForwardedHeaders
+go test -v -run=TestWebSocketMode
+go test -v -run=TestWithErrorCounter
+go test -v -run=TestWithTTFB
+go test -v -run=TestHandlerNameFromContext
+go test -v -run=TestURLLabelFromContext
+go test -v -run=TestRequestCounterURLLabelMappingFunc
+go test -v -run=TestMetricNames
+go test -v -run=TestNamespaceSanitized
+go test -v -run=TestUnregister
+go test -v -run=TestRegistryReleased
+go test -v -run=TestNewTwiceOnDefaultRegistry
+go test -v -run=TestConcurrencyHistogram
+go test -v -run=TestSampleRate
+go test -v -run=TestRequestSizeChunkedBody
+go test -v -run=TestCatchAllRouteLabel
+go test -v -run=TestMetricsEndpointRecorded
+go test -v -run=TestSnapshot
+go test -v -run=TestReset$
+go test -v -run=TestResetRecordsNotFound
+go test -v -run=TestResetWithReader
+go test -v -run=TestTemporality
+go test -v -run=TestReloadStopsRecordWorker
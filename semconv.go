@@ -1,8 +1,16 @@
 package echootelmetrics
 
-import "go.opentelemetry.io/otel/attribute"
+import (
+	"net/http"
+	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+)
 
 const (
+	// MetricRequests requests, the request counter exported as `requests_total`, not part of the semconv
+	MetricRequests = "requests"
+
 	// MetricHTTPServerRequestDuration http.server.request.duration https://opentelemetry.io/docs/specs/semconv/http/http-metrics/#metric-httpserverrequestduration
 	MetricHTTPServerRequestDuration = "http.server.request.duration"
 
@@ -14,6 +22,72 @@ const (
 
 	// MetricHTTPServerResponseBodySize http.server.response.body.size https://opentelemetry.io/docs/specs/semconv/http/http-metrics/#metric-httpserverresponsebodysize
 	MetricHTTPServerResponseBodySize = "http.server.response.body.size"
+
+	// MetricHTTPServerRequestsNotReady http.server.requests_not_ready, not part of the semconv
+	MetricHTTPServerRequestsNotReady = "http.server.requests_not_ready"
+
+	// MetricHTTPServerBindDuration http.server.bind.duration, not part of the semconv
+	MetricHTTPServerBindDuration = "http.server.bind.duration"
+
+	// MetricHTTPServerWriteTimeout http.server.write_timeout, not part of the semconv
+	MetricHTTPServerWriteTimeout = "http.server.write_timeout"
+
+	// MetricHTTPServerResponseUncompressedCompressible http.server.response.uncompressed_compressible, not part of the semconv
+	MetricHTTPServerResponseUncompressedCompressible = "http.server.response.uncompressed_compressible"
+
+	// MetricHTTPServerErrors http.server.errors, not part of the semconv
+	MetricHTTPServerErrors = "http.server.errors"
+
+	// MetricHTTPServerWebSocketConnections http.server.websocket.connections, not part of the semconv
+	MetricHTTPServerWebSocketConnections = "http.server.websocket.connections"
+
+	// MetricHTTPServerBodyLimitRejected http.server.body_limit.rejected, not part of the semconv
+	MetricHTTPServerBodyLimitRejected = "http.server.body_limit.rejected"
+
+	// MetricHTTPServerRequestDurationTrimmed http.server.request.duration.trimmed, not part of the semconv
+	MetricHTTPServerRequestDurationTrimmed = "http.server.request.duration.trimmed"
+
+	// MetricHTTPServerRequestDurationLong http.server.request.duration.long, not part of the semconv
+	MetricHTTPServerRequestDurationLong = "http.server.request.duration.long"
+
+	// MetricHTTPServerRequestTimeToFirstByte http.server.request.time_to_first_byte, not part of the semconv
+	MetricHTTPServerRequestTimeToFirstByte = "http.server.request.time_to_first_byte"
+
+	// MetricHTTPServerConcurrency http.server.concurrency, not part of the semconv
+	MetricHTTPServerConcurrency = "http.server.concurrency"
+
+	// MetricHTTPServerRequestDurationClamped http.server.request.duration.clamped, not part of the semconv
+	MetricHTTPServerRequestDurationClamped = "http.server.request.duration.clamped"
+
+	// MetricHTTPServerRequestURLLength http.server.request.url.length, not part of the semconv
+	MetricHTTPServerRequestURLLength = "http.server.request.url.length"
+
+	// MetricHTTPServerRequestHeaderSize http.server.request.header.size, not part of the semconv
+	MetricHTTPServerRequestHeaderSize = "http.server.request.header.size"
+
+	// MetricHTTPServerResponseSetCookieCount http.server.response.set_cookie.count, not part of the semconv
+	MetricHTTPServerResponseSetCookieCount = "http.server.response.set_cookie.count"
+
+	// MetricMetricsDropped metrics.dropped, the number of recordings dropped by the async recorder
+	MetricMetricsDropped = "metrics.dropped"
+
+	// MetricHTTPServerRouteConcurrencyUtilization http.server.route.concurrency.utilization, not part of the semconv
+	MetricHTTPServerRouteConcurrencyUtilization = "http.server.route.concurrency.utilization"
+
+	// MetricHTTPServerWorkerPoolActive http.server.worker_pool.active, not part of the semconv
+	MetricHTTPServerWorkerPoolActive = "http.server.worker_pool.active"
+
+	// MetricHTTPServerWorkerPoolCapacity http.server.worker_pool.capacity, not part of the semconv
+	MetricHTTPServerWorkerPoolCapacity = "http.server.worker_pool.capacity"
+
+	// MetricHTTPServerWorkerPoolUtilization http.server.worker_pool.utilization, not part of the semconv
+	MetricHTTPServerWorkerPoolUtilization = "http.server.worker_pool.utilization"
+
+	// MetricHTTPServerBuildInfo http.server.build_info, a constant gauge describing the running build
+	MetricHTTPServerBuildInfo = "http.server.build_info"
+
+	// MetricConfigInfo echo_otel_metrics.config_info, a constant gauge describing the middleware configuration
+	MetricConfigInfo = "echo_otel_metrics.config_info"
 )
 
 const (
@@ -45,3 +119,73 @@ const (
 	// HttpResponseStatusCode http.response.status_code
 	HttpResponseStatusCode = attribute.Key("http.response.status_code")
 )
+
+const (
+	// HttpResponseStatusClass http.response.status_class, the class of the status code like "2xx"
+	HttpResponseStatusClass = attribute.Key("http.response.status_class")
+
+	// HasTrailers has_trailers, whether the response carries HTTP trailers
+	HasTrailers = attribute.Key("has_trailers")
+
+	// ResponseSerializer response.serializer, one of json, xml, protobuf or other
+	ResponseSerializer = attribute.Key("response.serializer")
+
+	// Outcome outcome, the business outcome of the request, success or error
+	Outcome = attribute.Key("outcome")
+
+	// ClientCertPresent client.cert.present, whether the TLS client presented a certificate
+	ClientCertPresent = attribute.Key("client.cert.present")
+
+	// TraceSampled trace_sampled, whether the span of the request is sampled
+	TraceSampled = attribute.Key("trace_sampled")
+
+	// ServiceInstanceID service.instance.id
+	ServiceInstanceID = attribute.Key("service.instance.id")
+
+	// ServiceVersion service.version
+	ServiceVersion = attribute.Key("service.version")
+
+	// GoVersion go.version, the Go runtime version, e.g. go1.23.4
+	GoVersion = attribute.Key("go.version")
+
+	// Commit commit, the VCS revision the binary was built from
+	Commit = attribute.Key("commit")
+
+	// ClientIsBot client.is_bot, whether the User-Agent looks like a bot or crawler
+	ClientIsBot = attribute.Key("client.is_bot")
+
+	// CacheResult cache.result, one of hit, miss or bypass
+	CacheResult = attribute.Key("cache.result")
+
+	// EndpointType endpoint_type, one of rest, stream or websocket
+	EndpointType = attribute.Key("endpoint_type")
+
+	// Handler handler, the logical handler name set with MiddlewareConfig.HandlerNameFromContext
+	Handler = attribute.Key("handler")
+
+	// WorkerPoolName worker_pool.name, the name passed to RegisterWorkerPool
+	WorkerPoolName = attribute.Key("worker_pool.name")
+)
+
+// otherMethod is the http.request.method of the requests with a non-standard method, per the semconv
+const otherMethod = "_OTHER"
+
+// normalizeMethod maps the methods outside of the standard set (GET, POST...) to "_OTHER",
+// so arbitrary method strings sent by clients do not create new series.
+func normalizeMethod(m string) string {
+	switch m {
+	case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch,
+		http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodConnect:
+		return m
+	default:
+		return otherMethod
+	}
+}
+
+// statusClass maps a status code to its class, e.g. 404 to "4xx"
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
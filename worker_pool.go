@@ -0,0 +1,90 @@
+package echootelmetrics
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// workerPool is the pair of funcs passed to RegisterWorkerPool
+type workerPool struct {
+	active, capacity func() int
+	attrs            attribute.Set
+}
+
+// workerPools holds the pools registered with RegisterWorkerPool,
+// it is shared by the instances built by Reload.
+type workerPools struct {
+	mu    sync.RWMutex
+	pools map[string]workerPool
+}
+
+// RegisterWorkerPool reports the saturation of a fixed worker pool, e.g. the one serving the SSE or
+// streaming handlers, in the `http.server.worker_pool.active`, `http.server.worker_pool.capacity` and
+// `http.server.worker_pool.utilization` (active/capacity) gauges, labeled with worker_pool.name.
+// Both funcs are called on every collection and must be safe for concurrent use.
+//
+// Registering a name again replaces its funcs. The utilization is not reported while capacity() returns 0 or less.
+func (p *Metrics) RegisterWorkerPool(name string, active, capacity func() int) {
+	pools := p.active().workerPools
+	pools.mu.Lock()
+	defer pools.mu.Unlock()
+	if pools.pools == nil {
+		pools.pools = make(map[string]workerPool)
+	}
+	pools.pools[name] = workerPool{
+		active:   active,
+		capacity: capacity,
+		attrs:    attribute.NewSet(WorkerPoolName.String(name)),
+	}
+}
+
+// registerWorkerPools installs the gauges observing the pools registered with RegisterWorkerPool
+func (p *Metrics) registerWorkerPools(meter metric.Meter) error {
+	active, err := meter.Int64ObservableGauge(
+		MetricHTTPServerWorkerPoolActive,
+		metric.WithDescription("Number of busy workers of the worker pool."),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create %s gauge: %w", MetricHTTPServerWorkerPoolActive, err)
+	}
+
+	capacity, err := meter.Int64ObservableGauge(
+		MetricHTTPServerWorkerPoolCapacity,
+		metric.WithDescription("Number of workers of the worker pool."),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create %s gauge: %w", MetricHTTPServerWorkerPoolCapacity, err)
+	}
+
+	utilization, err := meter.Float64ObservableGauge(
+		MetricHTTPServerWorkerPoolUtilization,
+		metric.WithUnit("1"),
+		metric.WithDescription("Utilization of the worker pool, from 0 to 1."),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create %s gauge: %w", MetricHTTPServerWorkerPoolUtilization, err)
+	}
+
+	_, err = meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		pools := p.workerPools
+		pools.mu.RLock()
+		defer pools.mu.RUnlock()
+		for _, pool := range pools.pools {
+			busy, size := pool.active(), pool.capacity()
+			o.ObserveInt64(active, int64(busy), metric.WithAttributeSet(pool.attrs))
+			o.ObserveInt64(capacity, int64(size), metric.WithAttributeSet(pool.attrs))
+			if size > 0 {
+				o.ObserveFloat64(utilization, float64(busy)/float64(size), metric.WithAttributeSet(pool.attrs))
+			}
+		}
+		return nil
+	}, active, capacity, utilization)
+	if err != nil {
+		return fmt.Errorf("failed to register the worker pool callback: %w", err)
+	}
+	return nil
+}